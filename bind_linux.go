@@ -0,0 +1,22 @@
+package ping
+
+import (
+	"os"
+	"syscall"
+)
+
+// bindToDevice restricts c to sending and receiving on the network
+// interface name, regardless of what the routing table says.
+func bindToDevice(c syscall.Conn, name string) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ping
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+func bindToDevice(c syscall.Conn, name string) error {
+	return errors.New("binding to an interface is not supported on " + runtime.GOOS)
+}
@@ -1,43 +1,255 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"ping"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
+	"golang.org/x/term"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
 	debug    = kingpin.Flag("debug", "Enable debug mode.").Bool()
-	timeout  = kingpin.Flag("timeout", "Timeout waiting for ping in second.").Default("5s").Short('t').Duration()
+	pktWait  = kingpin.Flag("packet-timeout", "Time to wait for each reply.").Default("5s").Short('W').Duration()
+	timeout  = kingpin.Flag("timeout", "Deprecated alias of --packet-timeout.").Short('t').Duration()
 	count    = kingpin.Flag("count", "Number of packets to send. default will be never end.").Default("-1").Short('c').Int()
+	deadline = kingpin.Flag("deadline", "Stop after this long, however many packets are left to send.").Short('w').Duration()
+	maxLoss  = kingpin.Flag("max-loss", "Stop after this many packets in a row are lost.").Int()
 	interval = kingpin.Flag("interval", "Interval of Ping").Default("1s").Short('i').Duration()
 	localIp  = kingpin.Flag("local-ip", "Set local ip").Default("0.0.0.0").Short('l').IP()
-	remoteIp = kingpin.Arg("ip", "IP address to ping.").Required().IP()
+	size     = kingpin.Flag("size", "Number of data bytes to send.").Default("56").Short('s').Int()
+	sweepMin = kingpin.Flag("sweep-min", "Payload size to start a size sweep at.").Short('g').Int()
+	sweepMax = kingpin.Flag("sweep-max", "Payload size to end a size sweep at.").Short('G').Int()
+	sweepInc = kingpin.Flag("sweep-step", "Payload size to add with every request of a sweep.").Short('h').Int()
+	flood    = kingpin.Flag("flood", "Send packets as fast as replies come back, printing a dot per request and a backspace per reply.").Short('f').Bool()
+	adaptive = kingpin.Flag("adaptive", "Adapt the interval to the round-trip time.").Short('A').Bool()
+	pattern  = kingpin.Flag("pattern", "Fill the payload with this hex pattern, e.g. ff00.").Short('p').HexBytes()
+	tos      = kingpin.Flag("tos", "Set the type of service, or traffic class for IPv6, of echo requests.").Short('Q').Int()
+	noFrag   = kingpin.Flag("dont-fragment", "Set the Don't Fragment bit.").Short('M').Bool()
+	route    = kingpin.Flag("record-route", "Record the route in the IP Record Route option.").Short('R').Bool()
+	stamp    = kingpin.Flag("timestamp", "Record timestamps in the IP Timestamp option.").Short('T').Bool()
+	dryRun   = kingpin.Flag("dry-run", "Check that ping could run, without sending anything, and exit.").Bool()
+	pmtu     = kingpin.Flag("pmtu", "Discover the path MTU to the host and exit.").Bool()
+	iface    = kingpin.Flag("interface", "Send packets through the given network interface.").Short('I').String()
+	ident    = kingpin.Flag("identifier", "Set the ICMP echo identifier.").Short('e').Envar("PING_IDENTIFIER").Int()
+	seed     = kingpin.Flag("payload-seed", "Fill the payload with bytes generated from this seed, the same every run.").Envar("PING_PAYLOAD_SEED").Int64()
+	ttl      = kingpin.Flag("ttl", "Set the IP time to live.").Default("0").Int()
+	rcvbuf   = kingpin.Flag("rcvbuf", "Set the socket receive buffer size in bytes, e.g. for flood ping.").Int()
+	numeric  = kingpin.Flag("numeric", "Don't look up the names of the addresses replies come from.").Short('n').Bool()
+	quiet    = kingpin.Flag("quiet", "Only print the summary at the end.").Short('q').Bool()
+	bell     = kingpin.Flag("audible", "Ring the terminal bell on every reply.").Short('a').Bool()
+	bellLoss = kingpin.Flag("audible-loss", "Ring the terminal bell on every lost packet.").Bool()
+	csvOut   = kingpin.Flag("csv", "Write every packet to this file as a CSV row.").String()
+	jsonOut  = kingpin.Flag("json", "Print the final statistics as JSON.").Bool()
+	unpriv   = kingpin.Flag("unprivileged", "Use an unprivileged ICMP datagram socket instead of a raw socket.").Bool()
+	remote   = kingpin.Arg("host", "Host or IP address to ping, or a network such as 192.168.1.0/24 to ping each of its hosts once.").Required().String()
+)
+
+// Exit codes, as with ping(8): 1 if no reply came back at all, 2 if ping
+// couldn't even be started.
+const (
+	exitNoReply = 1
+	exitError   = 2
 )
 
 func main() {
 	kingpin.Version("0.1.0")
+	kingpin.CommandLine.Terminate(func(code int) {
+		if code != 0 {
+			code = exitError
+		}
+		os.Exit(code)
+	})
 	kingpin.Parse()
-	if ping.Privileged != true {
-		fmt.Println(ping.NonPrivMsg)
-		os.Exit(1)
-	}
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	pinger := ping.NewPinger(localIp.String(), remoteIp.String(), *timeout, *count)
-	pinger.Verbose = true
+	if *timeout != 0 {
+		fmt.Fprintln(os.Stderr, "--timeout is deprecated and will be removed, use --packet-timeout (-W), or --deadline (-w) to limit the whole run")
+		*pktWait = *timeout
+	}
+	if !ping.HasPrivilege() && *debug {
+		fmt.Fprintf(os.Stderr, "%s, falling back to unprivileged ICMP\n", ping.NonPrivMsg)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if strings.Contains(*remote, "/") {
+		os.Exit(sweep(*remote))
+	}
+	pinger, err := ping.NewPingerE(localIp.String(), *remote, *pktWait, *count)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitError)
+	}
+	pinger.Verbose = !*quiet
+	pinger.ResolveNames = !*numeric
+	pinger.Interval = *interval
+	pinger.Deadline = *deadline
+	pinger.MaxConsecutiveLoss = *maxLoss
+	pinger.Size = *size
+	pinger.MinSize, pinger.MaxSize, pinger.SizeStep = *sweepMin, *sweepMax, *sweepInc
+	if *sweepMax > 0 && *sweepInc == 0 {
+		pinger.SizeStep = 1
+	}
+	pinger.TTL = *ttl
+	pinger.RecvBufferSize = *rcvbuf
+	pinger.Identifier = *ident
+	pinger.Interface = *iface
+	pinger.DontFragment = *noFrag
+	pinger.TOS = *tos
+	pinger.Pattern = *pattern
+	pinger.PayloadSeed = *seed
+	pinger.RecordRoute = *route
+	pinger.Timestamp = *stamp
+	pinger.Flood = *flood
+	pinger.Adaptive = *adaptive
+	if *flood {
+		pinger.Verbose = false
+		pinger.OnSend = func(*ping.Packet) { fmt.Print(".") }
+		pinger.OnRecv = func(*ping.Packet) { fmt.Print("\b \b") }
+	}
+	if *csvOut != "" {
+		f, err := os.Create(*csvOut)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+		defer f.Close()
+		w := ping.NewCSVWriter(f)
+		write := func(pkt *ping.Packet) {
+			if err := w.Write(pkt); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		pinger.OnRecv = chain(pinger.OnRecv, write)
+		pinger.OnDuplicate = write
+		pinger.OnLost = write
+	}
+	if isTerminal(os.Stdout) {
+		ring := func(*ping.Packet) { fmt.Print("\a") }
+		if *bell {
+			pinger.OnRecv = chain(pinger.OnRecv, ring)
+		}
+		if *bellLoss {
+			pinger.OnLost = chain(pinger.OnLost, ring)
+		}
+	}
+	if *unpriv {
+		pinger.Privileged = false
+	}
+	if *dryRun {
+		if err := pinger.Validate(); err != nil {
+			printError(err)
+			os.Exit(exitError)
+		}
+		return
+	}
+	if *pmtu {
+		mtu, err := pinger.DiscoverMTU()
+		if err != nil {
+			printError(err)
+			os.Exit(exitError)
+		}
+		fmt.Printf("path MTU to %s (%s): %d\n", pinger.Addr(), pinger.IPAddr(), mtu)
+		return
+	}
+	// an error opening the socket is printed once RunContext returns, and
+	// without a socket there is nothing to announce or sum up
+	verbose, started := pinger.Verbose, false
+	pinger.Verbose = false
+	pinger.OnSetup = func() {
+		started = true
+		pinger.Verbose = verbose
+		if !*jsonOut {
+			fmt.Printf("PING %s (%s)\n", pinger.Addr(), pinger.IPAddr())
+		}
+	}
 	pinger.OnFinish = func(stat *ping.Statistics) {
-		fmt.Println("--- ping statistics ---")
-		fmt.Printf("%+v\n", *stat)
-	}
-	go func() {
-		<-c
-		pinger.Finish()
-		os.Exit(0)
-	}()
-	pinger.Run()
+		if !started {
+			return
+		}
+		if *jsonOut {
+			json.NewEncoder(os.Stdout).Encode(stat)
+			return
+		}
+		if *flood {
+			fmt.Println()
+		}
+		fmt.Printf("--- %s ping statistics ---\n", pinger.Addr())
+		fmt.Println(stat)
+	}
+	if err := pinger.RunContext(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		printError(err)
+		os.Exit(exitError)
+	}
+	if pinger.Statistics().PacketsRecv == 0 {
+		os.Exit(exitNoReply)
+	}
+}
+
+// sweep pings each host of the network cidr once, prints whether it is
+// alive in address order, and returns the exit code.
+func sweep(cidr string) int {
+	stats, err := ping.PingCIDR(cidr, *pktWait)
+	if err != nil {
+		printError(err)
+		return exitError
+	}
+	hosts := make([]string, 0, len(stats))
+	for host := range stats {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(hosts[i]).To16(), net.ParseIP(hosts[j]).To16()) < 0
+	})
+	alive := 0
+	for _, host := range hosts {
+		s := stats[host]
+		switch {
+		case s.PacketsRecv > 0:
+			alive++
+			fmt.Printf("%s is alive (%.3f ms)\n", host, float64(s.AvgRtt)/float64(time.Millisecond))
+		case !*quiet:
+			fmt.Printf("%s is unreachable\n", host)
+		}
+	}
+	fmt.Printf("--- %s ping sweep ---\n%d of %d hosts alive\n", cidr, alive, len(hosts))
+	if alive == 0 {
+		return exitNoReply
+	}
+	return 0
+}
+
+// printError prints err, with a hint at --unprivileged if raw sockets were
+// denied.
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	if errors.Is(err, ping.ErrNoPrivilege) {
+		fmt.Fprintln(os.Stderr, "use --unprivileged to ping without raw sockets")
+	}
+}
+
+// chain returns a handler calling f, if set, then g.
+func chain(f, g func(*ping.Packet)) func(*ping.Packet) {
+	if f == nil {
+		return g
+	}
+	return func(pkt *ping.Packet) {
+		f(pkt)
+		g(pkt)
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file, a pipe or
+// another device such as /dev/null.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
 }
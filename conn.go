@@ -0,0 +1,25 @@
+package ping
+
+import "net"
+
+// rawConn makes a listening raw socket behave like one connected to raddr
+// for sending. It still receives ICMP messages from any address, such as
+// errors from routers on the way, leaving it to the echo identifier and the
+// source address to tell the replies of raddr apart.
+type rawConn struct {
+	*net.IPConn
+	raddr *net.IPAddr
+}
+
+func (c *rawConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *rawConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *rawConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package ping
+
+import (
+	"context"
+	"net"
+)
+
+// rawIPHeader reports whether raw IPv4 sockets deliver packets with their
+// IP header.
+const rawIPHeader = true
+
+// dialRaw opens a raw ICMP socket bound to laddr for raddr, with
+// SO_REUSEADDR set. It is left unconnected: the kernel would otherwise drop
+// the ICMP errors routers on the way send from their own addresses.
+func dialRaw(ipv4 bool, laddr, raddr *net.IPAddr) (net.Conn, error) {
+	network := "ip4:icmp"
+	if !ipv4 {
+		network = "ip6:ipv6-icmp"
+	}
+	// an unspecified address of either family binds to any of the
+	// family of raddr
+	var address string
+	if laddr != nil && laddr.IP != nil && !laddr.IP.IsUnspecified() {
+		address = laddr.String()
+	}
+	lc := net.ListenConfig{Control: reuseAddr}
+	c, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{IPConn: c.(*net.IPConn), raddr: raddr}, nil
+}
+
+// readMsg reads a packet into b along with its control messages and source
+// address.
+func (c *rawConn) readMsg(b, oob []byte) (n, oobn int, src *net.IPAddr, err error) {
+	n, oobn, _, src, err = c.ReadMsgIP(b, oob)
+	return
+}
@@ -0,0 +1,41 @@
+package ping
+
+import "net"
+
+// rawIPHeader reports whether raw IPv4 sockets deliver packets with their
+// IP header. ReadFrom strips it.
+const rawIPHeader = false
+
+// dialRaw opens a raw ICMP socket bound to laddr for raddr. Windows can't
+// connect raw sockets, which would drop the errors of routers on the way
+// anyway.
+func dialRaw(ipv4 bool, laddr, raddr *net.IPAddr) (net.Conn, error) {
+	network := "ip4:icmp"
+	if !ipv4 {
+		network = "ip6:ipv6-icmp"
+	}
+	if laddr == nil || laddr.IP == nil || laddr.IP.IsUnspecified() {
+		// raw sockets must be bound to an address of the host; let
+		// the route to raddr pick it
+		udp, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: raddr.IP, Port: 9, Zone: raddr.Zone})
+		if err != nil {
+			return nil, err
+		}
+		laddr = &net.IPAddr{IP: udp.LocalAddr().(*net.UDPAddr).IP}
+		udp.Close()
+	}
+	c, err := net.ListenIP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{IPConn: c, raddr: raddr}, nil
+}
+
+// readMsg reads a packet into b along with its source address. ReadFrom
+// reports no control messages.
+func (c *rawConn) readMsg(b, oob []byte) (n, oobn int, src *net.IPAddr, err error) {
+	var addr net.Addr
+	n, addr, err = c.ReadFrom(b)
+	src = ipAddr(addr)
+	return
+}
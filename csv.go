@@ -0,0 +1,65 @@
+package ping
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CSVWriter writes packets as CSV rows of
+//
+//	seq,timestamp,rtt_ms,ttl,bytes,result
+//
+// where result is reply, duplicate, timeout or the ICMP error received, and
+// rtt_ms, ttl and bytes are empty for lost packets. Its Write method can be
+// called from OnRecv, OnDuplicate and OnLost.
+type CSVWriter struct {
+	mu     sync.Mutex
+	w      *csv.Writer
+	header bool
+}
+
+// NewCSVWriter returns a CSVWriter writing to w. The header row goes out
+// with the first packet.
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+// Write writes packet as a row and flushes it, so that rows show up as the
+// packets arrive.
+func (c *CSVWriter) Write(packet *Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.header {
+		c.header = true
+		if err := c.w.Write([]string{"seq", "timestamp", "rtt_ms", "ttl", "bytes", "result"}); err != nil {
+			return err
+		}
+	}
+	at := packet.RecvAt
+	if at.IsZero() {
+		at = packet.SentAt
+	}
+	row := []string{strconv.Itoa(packet.Seq), at.Format(time.RFC3339Nano), "", "", "", ""}
+	switch {
+	case packet.Err != nil:
+		row[5] = packet.Err.Error()
+	case packet.Lost:
+		row[5] = "timeout"
+	default:
+		row[2] = strconv.FormatFloat(ms(packet.Rtt), 'f', 3, 64)
+		row[3] = strconv.Itoa(packet.TTL)
+		row[4] = strconv.Itoa(packet.Nbytes)
+		row[5] = "reply"
+		if packet.Duplicate {
+			row[5] = "duplicate"
+		}
+	}
+	if err := c.w.Write(row); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,14 @@
+package ping
+
+import "syscall"
+
+// setDontFragment sets the Don't Fragment bit on packets sent on c, or for
+// IPv6 keeps the kernel from fragmenting them, so that oversized packets
+// fail instead.
+func setDontFragment(c syscall.Conn, ipv4 bool) error {
+	level, opt, val := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO
+	if !ipv4 {
+		level, opt, val = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO
+	}
+	return setsockoptInt(c, level, opt, val)
+}
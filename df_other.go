@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ping
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+func setDontFragment(c syscall.Conn, ipv4 bool) error {
+	return errors.New("setting the don't fragment bit is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package ping
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+func dialDgram(ipv4 bool, laddr, raddr *net.IPAddr, id int) (net.Conn, error) {
+	return nil, errors.New("unprivileged ping is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,57 @@
+//go:build linux || darwin
+
+package ping
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// dialDgram opens an unprivileged ICMP datagram socket connected to raddr.
+// Unlike a raw socket it does not require root or CAP_NET_RAW, but the
+// kernel picks the echo identifier itself and only delivers replies
+// addressed to that identifier. On Linux the identifier is the port the
+// socket is bound to, so a non-zero id picks it.
+func dialDgram(ipv4 bool, laddr, raddr *net.IPAddr, id int) (net.Conn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if !ipv4 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	rc, err := f.SyscallConn()
+	if err == nil {
+		err = reuseAddr("", "", rc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sockaddr(family, laddr.IP, id)); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Connect(fd, sockaddr(family, raddr.IP, 0)); err != nil {
+		return nil, os.NewSyscallError("connect", err)
+	}
+	return net.FileConn(f)
+}
+
+func sockaddr(family int, ip net.IP, port int) syscall.Sockaddr {
+	if family == syscall.AF_INET {
+		sa := &syscall.SockaddrInet4{Port: port}
+		if ip != nil && !ip.IsUnspecified() {
+			copy(sa.Addr[:], ip.To4())
+		}
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: port}
+	if ip != nil && !ip.IsUnspecified() {
+		copy(sa.Addr[:], ip.To16())
+	}
+	return sa
+}
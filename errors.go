@@ -0,0 +1,84 @@
+package ping
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Errors callers can tell failures apart with, using errors.Is. The errors
+// returned wrap them along with the underlying error, which errors.Is and
+// errors.As still find. ErrNoPrivilege is another.
+var (
+	// ErrTimeout is reported when no reply came back within Timeout.
+	ErrTimeout = errors.New("timeout waiting for reply")
+
+	// ErrUnreachable is reported when the target can't be reached: the
+	// system has no route to it, or an ICMP Destination Unreachable error
+	// came back.
+	ErrUnreachable = errors.New("destination unreachable")
+
+	// ErrParse is reported for a message received that isn't valid ICMP.
+	ErrParse = errors.New("invalid ICMP message")
+)
+
+// kindError is an error of one of the kinds above. Its message is that of
+// err, which it unwraps to.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// classify wraps err, an error of the network, in the kind it is of, if
+// any.
+func classify(err error) error {
+	var nerr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return &kindError{kind: ErrTimeout, err: err}
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return &kindError{kind: ErrUnreachable, err: err}
+	}
+	return err
+}
+
+// ICMPError is the Packet.Err of a request answered by an ICMP error
+// message. A Destination Unreachable error is ErrUnreachable.
+type ICMPError struct {
+	// Type is what the message means, ICMPType and ICMPCode its type and
+	// code as in Packet.
+	Type     ReplyType
+	ICMPType int
+	ICMPCode int
+
+	reason string
+}
+
+func (e *ICMPError) Error() string {
+	return e.reason
+}
+
+func (e *ICMPError) Is(target error) bool {
+	return target == ErrUnreachable && e.Type == DestUnreachable
+}
+
+// newICMPError returns the error of an ICMP error message of type typ and
+// code.
+func newICMPError(ipv4 bool, typ, code int) *ICMPError {
+	return &ICMPError{Type: replyType(ipv4, typ), ICMPType: typ, ICMPCode: code, reason: icmpErrorReason(ipv4, typ, code)}
+}
@@ -0,0 +1,264 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Group pings a set of targets at once over a single raw socket per address
+// family, instead of one socket per target. Replies are told apart by their
+// sequence number, which is unique across the group, and source address.
+//
+// Like Traceroute, a Group needs root or CAP_NET_RAW.
+type Group struct {
+	// Interval is the wait time between each round of echo requests.
+	// Default is 1s.
+	Interval time.Duration
+
+	// Timeout is how long to wait for a reply before counting it as lost.
+	// Default is 5s.
+	Timeout time.Duration
+
+	// Size of the echo payload. Default is 56.
+	Size int
+
+	id       int
+	lookupIP func(host string) ([]net.IP, error)
+
+	mu       sync.Mutex
+	targets  map[string]*Pinger
+	conns    map[bool]*net.IPConn // by ipv4
+	seq      int
+	awaiting map[int]groupRequest
+}
+
+type groupRequest struct {
+	target *Pinger
+	request
+}
+
+// NewGroup returns an empty Group.
+func NewGroup() *Group {
+	return &Group{
+		Interval: 1 * time.Second,
+		Timeout:  defaultTimeout,
+		Size:     defaultSize,
+		id:       newID(),
+		lookupIP: net.LookupIP,
+		targets:  make(map[string]*Pinger),
+	}
+}
+
+// Add resolves target and adds it to the group. Targets may be added while
+// the group is running; they are pinged from the next round on.
+func (g *Group) Add(target string) error {
+	p, err := New(target)
+	if err != nil {
+		return err
+	}
+	p.id = g.id
+	p.Privileged = true
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.targets[target]; !ok {
+		g.targets[target] = p
+	}
+	return nil
+}
+
+// AddAll resolves host and adds every one of its addresses to the group,
+// IPv4 and IPv6 alike, so that each member behind round-robin DNS or a
+// load balancer is pinged on its own. It returns the addresses added, in
+// the order they were resolved and without duplicates, which are the
+// targets to ask Statistics about.
+func (g *Group) AddAll(host string) ([]string, error) {
+	ips, err := g.lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		addr := ip.String()
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if err := g.Add(addr); err != nil {
+			return addrs, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Statistics returns the statistics of target, or nil if it was never
+// added.
+func (g *Group) Statistics(target string) *Statistics {
+	g.mu.Lock()
+	p := g.targets[target]
+	g.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.Statistics()
+}
+
+// Run pings every target each Interval until ctx is done.
+func (g *Group) Run(ctx context.Context) error {
+	g.mu.Lock()
+	g.conns = make(map[bool]*net.IPConn)
+	g.awaiting = make(map[int]groupRequest)
+	g.mu.Unlock()
+
+	recvErr := make(chan error, 2)
+	var wg sync.WaitGroup
+	defer func() {
+		g.mu.Lock()
+		for _, c := range g.conns {
+			c.Close()
+		}
+		g.mu.Unlock()
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		g.expire(now)
+		if err := g.sendRound(now, &wg, recvErr); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-recvErr:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendRound sends an echo request to every target, opening the socket for
+// its address family and starting a receiver on it first if need be.
+func (g *Group) sendRound(now time.Time, wg *sync.WaitGroup, recvErr chan<- error) error {
+	g.mu.Lock()
+	var failed []groupRequest
+	var errs []error
+	for _, p := range g.targets {
+		c := g.conns[p.ipv4]
+		if c == nil {
+			var err error
+			if c, err = g.listen(p.ipv4); err != nil {
+				g.mu.Unlock()
+				return err
+			}
+			g.conns[p.ipv4] = c
+			wg.Add(1)
+			go func(ipv4 bool) {
+				defer wg.Done()
+				if err := g.recvLoop(c, ipv4); !errors.Is(err, net.ErrClosed) {
+					recvErr <- err
+				}
+			}(p.ipv4)
+		}
+
+		p.Size = g.Size
+		seq := p.countSent(now)
+		xseq := g.seq & 0xffff
+		g.seq++
+		_, err := c.WriteTo(p.echoRequest(xseq, now), p.raddr)
+		if err != nil {
+			failed = append(failed, groupRequest{p, request{seq: seq, sentAt: now}})
+			errs = append(errs, classify(err))
+			continue
+		}
+		g.awaiting[xseq] = groupRequest{p, request{seq: seq, sentAt: now}}
+	}
+	g.mu.Unlock()
+	for i, req := range failed {
+		req.target.handleError(req.seq, errs[i])
+	}
+	return nil
+}
+
+// listen opens an unconnected raw socket, so that a single one receives the
+// replies of every target of the family.
+func (g *Group) listen(ipv4 bool) (*net.IPConn, error) {
+	network := "ip4:icmp"
+	if !ipv4 {
+		network = "ip6:ipv6-icmp"
+	}
+	c, err := net.ListenIP(network, nil)
+	if err != nil {
+		return nil, noPrivilege(err)
+	}
+	if !ipv4 {
+		if err = enableTTL(c, false); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// expire reports the requests that have waited longer than Timeout for a
+// reply as lost.
+func (g *Group) expire(now time.Time) {
+	var lost []groupRequest
+	g.mu.Lock()
+	for xseq, req := range g.awaiting {
+		if now.Sub(req.sentAt) >= g.Timeout {
+			lost = append(lost, req)
+			delete(g.awaiting, xseq)
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(lost, func(i, j int) bool { return lost[i].sentAt.Before(lost[j].sentAt) })
+	for _, req := range lost {
+		p := req.target
+		p.handleLost(&Packet{IPAddr: p.raddr, Addr: p.addr, Seq: req.seq, SentAt: req.sentAt})
+	}
+}
+
+// recvLoop hands the replies arriving on c to the target they answer.
+func (g *Group) recvLoop(c *net.IPConn, ipv4 bool) error {
+	// recv only needs to know the family and identifier to parse and
+	// match replies
+	r := &Pinger{ipv4: ipv4, id: g.id, Privileged: true, Size: g.Size}
+	rb := r.readBuffer()
+	defer putReadBuffer(rb)
+	for {
+		packet, src, err := r.recv(c, rb.b, rb.oob[:])
+		if err != nil {
+			return err
+		}
+		received := time.Now()
+		g.mu.Lock()
+		req, ok := g.awaiting[packet.Seq]
+		// errors come from routers on the way, replies from the target
+		if ok && (packet.Err != nil || src.IP.Equal(req.target.raddr.IP)) {
+			delete(g.awaiting, packet.Seq)
+		} else {
+			ok = false
+		}
+		g.mu.Unlock()
+		if !ok {
+			continue
+		}
+		p := req.target
+		packet.IPAddr, packet.Addr = p.raddr, p.addr
+		packet.Seq = req.seq
+		roundTrip(&packet, req.sentAt, received)
+		if packet.Err != nil {
+			p.handleLost(&packet)
+		} else {
+			p.handleRecv(&packet)
+		}
+	}
+}
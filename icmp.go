@@ -1,20 +1,27 @@
 package ping
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
-	icmpv4EchoRequest = 8
-	icmpv4EchoReply   = 0
-	icmpv6EchoRequest = 128
-	icmpv6EchoReply   = 129
+	icmpv4EchoRequest     = 8
+	icmpv4EchoReply       = 0
+	icmpv4DestUnreachable = 3
+	icmpv4TimeExceeded    = 11
+	icmpv6EchoRequest     = 128
+	icmpv6EchoReply       = 129
+	icmpv6DestUnreachable = 1
+	icmpv6PacketTooBig    = 2
+	icmpv6TimeExceeded    = 3
 )
 
 type icmpMessage struct {
-	Type        int
-	Code        int
-	SequenceNum int
-	Checksum    int
-	Body        icmpMessageBody
+	Type     int
+	Code     int
+	Checksum int
+	Body     icmpMessageBody
 }
 
 type icmpMessageBody interface {
@@ -25,7 +32,7 @@ type icmpMessageBody interface {
 // Marshal returns the binary enconding of the ICMP echo request or
 // reply message m.
 func (m *icmpMessage) Marshal() ([]byte, error) {
-	b := []byte{byte(m.Type), byte(m.Code), 0, 0, 0, 0, byte(m.SequenceNum / (2 << 7)), byte(m.SequenceNum)}
+	b := []byte{byte(m.Type), byte(m.Code), 0, 0}
 	if m.Body != nil && m.Body.Len() != 0 {
 		mb, err := m.Body.Marshal()
 		if err != nil {
@@ -37,21 +44,27 @@ func (m *icmpMessage) Marshal() ([]byte, error) {
 	case icmpv6EchoRequest, icmpv6EchoReply:
 		return b, nil
 	}
-	csumcv := len(b) - 1 // checksum coverage
-	s := uint32(0)
-	for i := 0; i < csumcv; i += 2 {
-		s += uint32(b[i+1])<<8 | uint32(b[i])
+	// Place checksum back in header; using ^= avoids the
+	// assumption the checksum bytes are zero.
+	s := checksum(b)
+	b[2] ^= byte(s >> 8)
+	b[3] ^= byte(s)
+	return b, nil
+}
+
+// checksum returns the Internet checksum of b (RFC 1071). It is 0 for a
+// message that carries a valid checksum.
+func checksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
 	}
-	if csumcv&1 == 0 {
-		s += uint32(b[csumcv])
+	if len(b)&1 == 1 {
+		s += uint32(b[len(b)-1]) << 8
 	}
 	s = s>>16 + s&0xffff
 	s = s + s>>16
-	// Place checksum back in header; using ^= avoids the
-	// assumption the checksum bytes are zero.
-	b[2] ^= byte(^s & 0xff)
-	b[3] ^= byte(^s >> 8)
-	return b, nil
+	return ^uint16(s)
 }
 
 // parseICMPMessage parses b as an ICMP message.
@@ -69,6 +82,12 @@ func parseICMPMessage(b []byte) (*icmpMessage, error) {
 			if err != nil {
 				return nil, err
 			}
+		case icmpv4DestUnreachable, icmpv4TimeExceeded, icmpv6DestUnreachable, icmpv6PacketTooBig:
+			// icmpv6TimeExceeded shares its type with icmpv4DestUnreachable
+			m.Body, err = parseICMPError(b[4:])
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 	return m, nil
@@ -99,12 +118,154 @@ func (p *icmpEcho) Marshal() ([]byte, error) {
 }
 
 // parseICMPEcho parses b as an ICMP echo request or reply message body.
+// Data is a slice of b rather than a copy, so that replies read into a
+// reused buffer cost no allocation for their payload.
 func parseICMPEcho(b []byte) (*icmpEcho, error) {
 	bodylen := len(b)
+	if bodylen < 4 {
+		return nil, errors.New("echo message too short")
+	}
 	p := &icmpEcho{ID: int(b[0])<<8 | int(b[1]), Seq: int(b[2])<<8 | int(b[3])}
 	if bodylen > 4 {
-		p.Data = make([]byte, bodylen-4)
-		copy(p.Data, b[4:])
+		p.Data = b[4:]
 	}
 	return p, nil
 }
+
+// icmpError represents the body of an ICMP Destination Unreachable or Time
+// Exceeded message, which quotes the start of the datagram that caused it.
+type icmpError struct {
+	Data []byte // IP header and at least 8 bytes of the original datagram
+}
+
+func (p *icmpError) Len() int {
+	if p == nil {
+		return 0
+	}
+	return 4 + len(p.Data)
+}
+
+// Marshal returns the binary encoding of the ICMP error message body p.
+func (p *icmpError) Marshal() ([]byte, error) {
+	b := make([]byte, 4+len(p.Data))
+	copy(b[4:], p.Data)
+	return b, nil
+}
+
+// parseICMPError parses b as an ICMP error message body.
+func parseICMPError(b []byte) (*icmpError, error) {
+	if len(b) < 4 {
+		return nil, errors.New("error message too short")
+	}
+	p := &icmpError{Data: make([]byte, len(b)-4)}
+	copy(p.Data, b[4:])
+	return p, nil
+}
+
+// echo returns the echo request quoted by the error message, or nil if it
+// quotes something else.
+func (p *icmpError) echo() *icmpEcho {
+	if len(p.Data) < 1 {
+		return nil
+	}
+	var b []byte
+	switch p.Data[0] >> 4 {
+	case 4:
+		hdrlen := int(p.Data[0]&0x0f) << 2
+		if hdrlen < 20 || len(p.Data) < hdrlen || p.Data[9] != 1 {
+			return nil
+		}
+		b = p.Data[hdrlen:]
+	case 6:
+		// extension headers aren't followed
+		if len(p.Data) < 40 || p.Data[6] != 58 {
+			return nil
+		}
+		b = p.Data[40:]
+	default:
+		return nil
+	}
+	if len(b) < 8 || (b[0] != icmpv4EchoRequest && b[0] != icmpv6EchoRequest) {
+		return nil
+	}
+	echo, err := parseICMPEcho(b[4:])
+	if err != nil {
+		return nil
+	}
+	return echo
+}
+
+// replyType returns the meaning of an ICMP message of type typ received in
+// response to an echo request.
+func replyType(ipv4 bool, typ int) ReplyType {
+	switch {
+	case ipv4 && typ == icmpv4EchoReply, !ipv4 && typ == icmpv6EchoReply:
+		return EchoReply
+	case ipv4 && typ == icmpv4TimeExceeded, !ipv4 && typ == icmpv6TimeExceeded:
+		return TimeExceeded
+	case ipv4 && typ == icmpv4DestUnreachable, !ipv4 && typ == icmpv6DestUnreachable:
+		return DestUnreachable
+	}
+	return Other
+}
+
+// tooBig reports whether the error message of type typ and code reports a
+// packet too big to be forwarded without fragmentation.
+func tooBig(ipv4 bool, typ, code int) bool {
+	if ipv4 {
+		return typ == icmpv4DestUnreachable && code == 4
+	}
+	return typ == icmpv6PacketTooBig
+}
+
+// icmpErrorReason describes the ICMP error message of type typ and code.
+func icmpErrorReason(ipv4 bool, typ, code int) string {
+	if ipv4 {
+		switch typ {
+		case icmpv4DestUnreachable:
+			switch code {
+			case 0:
+				return "destination net unreachable"
+			case 1:
+				return "destination host unreachable"
+			case 2:
+				return "destination protocol unreachable"
+			case 3:
+				return "destination port unreachable"
+			case 4:
+				return "fragmentation needed and DF set"
+			case 9, 10, 13:
+				return "communication administratively prohibited"
+			}
+			return fmt.Sprintf("destination unreachable, code %d", code)
+		case icmpv4TimeExceeded:
+			if code == 1 {
+				return "fragment reassembly time exceeded"
+			}
+			return "time to live exceeded"
+		}
+	} else {
+		switch typ {
+		case icmpv6DestUnreachable:
+			switch code {
+			case 0:
+				return "no route to destination"
+			case 1:
+				return "communication administratively prohibited"
+			case 3:
+				return "address unreachable"
+			case 4:
+				return "port unreachable"
+			}
+			return fmt.Sprintf("destination unreachable, code %d", code)
+		case icmpv6PacketTooBig:
+			return "packet too big"
+		case icmpv6TimeExceeded:
+			if code == 1 {
+				return "fragment reassembly time exceeded"
+			}
+			return "hop limit exceeded"
+		}
+	}
+	return fmt.Sprintf("icmp type %d, code %d", typ, code)
+}
@@ -0,0 +1,131 @@
+package ping
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	ipoptEnd         = 0
+	ipoptNop         = 1
+	ipoptRecordRoute = 7
+	ipoptTimestamp   = 68
+	ipoptMaxLen      = 40
+)
+
+var (
+	errIPOptions     = errors.New("IP options require a privileged IPv4 pinger")
+	errIPOptionsBoth = errors.New("record route and timestamps can't be asked for at once")
+)
+
+// recordRouteOption returns the IPv4 Record Route option with room for as
+// many addresses as fit in the header, preceded by a NOP to align them.
+func recordRouteOption() []byte {
+	b := make([]byte, ipoptMaxLen)
+	b[0] = ipoptNop
+	b[1] = ipoptRecordRoute
+	b[2] = ipoptMaxLen - 1 // length
+	b[3] = 4               // pointer to the first free slot, counting from 1
+	return b
+}
+
+// timestampOption returns the IPv4 Timestamp option with room for as many
+// timestamps, without addresses, as fit in the header.
+func timestampOption() []byte {
+	b := make([]byte, ipoptMaxLen)
+	b[0] = ipoptTimestamp
+	b[1] = ipoptMaxLen // length
+	b[2] = 5           // pointer to the first free slot, counting from 1
+	b[3] = 0           // overflow and flags, timestamps only
+	return b
+}
+
+// ipOptions returns the IPv4 options to set on echo requests, or nil for
+// none.
+func (p *Pinger) ipOptions() ([]byte, error) {
+	if !p.RecordRoute && !p.Timestamp {
+		return nil, nil
+	}
+	// the options only come back in the IP header of raw sockets
+	if !p.ipv4 || !p.hasIPHeader() {
+		return nil, errIPOptions
+	}
+	// either takes up all the room there is
+	switch {
+	case p.RecordRoute && p.Timestamp:
+		return nil, errIPOptionsBoth
+	case p.RecordRoute:
+		return recordRouteOption(), nil
+	}
+	return timestampOption(), nil
+}
+
+// ipOption returns the IPv4 option of type typ in the header of the
+// datagram b, or nil if there is none.
+func ipOption(b []byte, typ byte) []byte {
+	if len(b) < 20 {
+		return nil
+	}
+	hdrlen := int(b[0]&0x0f) << 2
+	if hdrlen > len(b) {
+		return nil
+	}
+	opts := b[20:hdrlen]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case ipoptEnd:
+			return nil
+		case ipoptNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return nil
+		}
+		if opts[0] == typ {
+			return opts[:opts[1]]
+		}
+		opts = opts[opts[1]:]
+	}
+	return nil
+}
+
+// parseRoute returns the addresses recorded in the Record Route option of
+// the datagram b, or nil if it has none.
+func parseRoute(b []byte) []net.IP {
+	opt := ipOption(b, ipoptRecordRoute)
+	if len(opt) < 3 {
+		return nil
+	}
+	// the pointer is one past the last address recorded
+	end := int(opt[2]) - 1
+	if end > len(opt) {
+		end = len(opt)
+	}
+	var route []net.IP
+	for i := 3; i+4 <= end; i += 4 {
+		route = append(route, net.IPv4(opt[i], opt[i+1], opt[i+2], opt[i+3]))
+	}
+	return route
+}
+
+// parseTimestamps returns the timestamps recorded in the Timestamp option of
+// the datagram b, as the time since midnight UT, or nil if it has none.
+func parseTimestamps(b []byte) []time.Duration {
+	opt := ipOption(b, ipoptTimestamp)
+	if len(opt) < 4 {
+		return nil
+	}
+	end := int(opt[2]) - 1
+	if end > len(opt) {
+		end = len(opt)
+	}
+	var ts []time.Duration
+	for i := 4; i+4 <= end; i += 4 {
+		// the high bit marks a non-standard time, which is kept as is
+		ts = append(ts, time.Duration(binary.BigEndian.Uint32(opt[i:]))*time.Millisecond)
+	}
+	return ts
+}
@@ -0,0 +1,21 @@
+package ping
+
+import (
+	"os"
+	"syscall"
+)
+
+// setIPOptions sets the IPv4 options of packets sent on c.
+func setIPOptions(c syscall.Conn, opts []byte) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(opts))
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ping
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+func setIPOptions(c syscall.Conn, opts []byte) error {
+	return errors.New("setting IP options is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,74 @@
+package ping
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	// minMTU is the smallest MTU every IPv4 link must support, and
+	// minMTU6 that of IPv6
+	minMTU  = 68
+	minMTU6 = 1280
+
+	// maxMTU is the largest MTU DiscoverMTU looks for, the most an IP
+	// packet can carry
+	maxMTU = 65535
+)
+
+// DiscoverMTU finds the path MTU to the target, the size of the largest IP
+// packet that reaches it without fragmentation. It binary searches the
+// payload size of echo requests sent with the Don't Fragment bit set, taking
+// a "fragmentation needed" (IPv6: "packet too big") error or no reply within
+// Timeout to mean that the packet was too large.
+//
+// DiscoverMTU changes Size while it runs, so it must not be called during
+// Run.
+func (p *Pinger) DiscoverMTU() (int, error) {
+	hdrLen, lo := 20+8, minMTU
+	if !p.ipv4 {
+		hdrLen, lo = 40+8, minMTU6
+	}
+	size, df := p.Size, p.DontFragment
+	defer func() {
+		p.Size, p.DontFragment = size, df
+	}()
+	p.DontFragment = true
+
+	fits := func(mtu int) (bool, error) {
+		p.Size = mtu - hdrLen
+		packet, err := p.Ping(mtu)
+		if err == nil {
+			return true, nil
+		}
+		var nerr net.Error
+		if tooBig(p.ipv4, packet.ICMPType, packet.ICMPCode) && packet.Err != nil ||
+			errors.Is(err, syscall.EMSGSIZE) || errors.As(err, &nerr) && nerr.Timeout() {
+			return false, nil
+		}
+		return false, err
+	}
+
+	ok, err := fits(lo)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("no reply to the smallest packets")
+	}
+	hi := maxMTU
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
@@ -0,0 +1,168 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	defaultCount   = -1
+)
+
+// Option configures a Pinger created by New.
+type Option func(*Pinger) error
+
+// New returns a Pinger for target, which may be an IP address or a hostname,
+// configured by opts. Unless overridden it pings every second until stopped,
+// waiting up to 5s for each reply.
+func New(target string, opts ...Option) (*Pinger, error) {
+	p := newPinger(&net.IPAddr{}, &net.IPAddr{}, target, defaultTimeout, defaultCount)
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	if p.Timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout %v", p.Timeout)
+	}
+	if err := p.resolve(target); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WithInterval sets the Interval between packets.
+func WithInterval(interval time.Duration) Option {
+	return func(p *Pinger) error {
+		p.Interval = interval
+		return nil
+	}
+}
+
+// WithCount sets the Count of packets to send, a negative count pings until
+// stopped.
+func WithCount(count int) Option {
+	return func(p *Pinger) error {
+		p.Count = count
+		return nil
+	}
+}
+
+// WithTimeout sets the Timeout to wait for each reply.
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *Pinger) error {
+		p.Timeout = timeout
+		return nil
+	}
+}
+
+// WithSize sets the Size of the echo payload.
+func WithSize(size int) Option {
+	return func(p *Pinger) error {
+		p.Size = size
+		return nil
+	}
+}
+
+// WithSource sets the local IP address to ping from. An empty address lets
+// the system choose.
+func WithSource(localIP string) Option {
+	return func(p *Pinger) error {
+		ip := net.ParseIP(localIP)
+		if localIP != "" && ip == nil {
+			return fmt.Errorf("invalid local address %q", localIP)
+		}
+		p.laddr = &net.IPAddr{IP: ip}
+		return nil
+	}
+}
+
+// WithPrivileged selects between a raw socket and an unprivileged datagram
+// socket, see Pinger.Privileged.
+func WithPrivileged(privileged bool) Option {
+	return func(p *Pinger) error {
+		p.Privileged = privileged
+		return nil
+	}
+}
+
+// WithLogger sets the Logger verbose output is written to.
+func WithLogger(logger Logger) Option {
+	return func(p *Pinger) error {
+		p.Logger = logger
+		return nil
+	}
+}
+
+// WithInterface sets the network Interface to send on.
+func WithInterface(name string) Option {
+	return func(p *Pinger) error {
+		p.Interface = name
+		return nil
+	}
+}
+
+// WithMaxStored sets the number of round-trip times kept, see
+// Pinger.MaxStored.
+func WithMaxStored(n int) Option {
+	return func(p *Pinger) error {
+		p.MaxStored = n
+		return nil
+	}
+}
+
+// WithDeadline sets the Deadline after which Run stops.
+func WithDeadline(deadline time.Duration) Option {
+	return func(p *Pinger) error {
+		p.Deadline = deadline
+		return nil
+	}
+}
+
+// WithDontFragment sets the Don't Fragment bit of echo requests.
+func WithDontFragment() Option {
+	return func(p *Pinger) error {
+		p.DontFragment = true
+		return nil
+	}
+}
+
+// WithTOS sets the TOS, or traffic class for IPv6, of echo requests.
+func WithTOS(tos int) Option {
+	return func(p *Pinger) error {
+		if tos < 0 || tos > 255 {
+			return errTOS
+		}
+		p.TOS = tos
+		return nil
+	}
+}
+
+// WithIdentifier sets the ICMP echo Identifier.
+func WithIdentifier(id int) Option {
+	return func(p *Pinger) error {
+		if id < 0 || id > 0xffff {
+			return errIdentifier
+		}
+		p.Identifier = id
+		return nil
+	}
+}
+
+// WithPattern sets the Pattern the echo payload is filled with.
+func WithPattern(pattern []byte) Option {
+	return func(p *Pinger) error {
+		p.Pattern = pattern
+		return nil
+	}
+}
+
+// WithPayloadSeed sets the PayloadSeed the echo payload is generated from.
+func WithPayloadSeed(seed int64) Option {
+	return func(p *Pinger) error {
+		p.PayloadSeed = seed
+		return nil
+	}
+}
@@ -1,6 +1,7 @@
 package ping
 
 import (
+	"fmt"
 	"net"
 	"time"
 )
@@ -16,12 +17,172 @@ type Packet struct {
 	// Addr is the string address of the host being pinged.
 	Addr string
 
+	// Src is the address the reply came from, if known. It differs from
+	// IPAddr for errors reported by routers on the way, and for replies
+	// from anycast or redirected addresses.
+	Src *net.IPAddr
+
+	// SrcName is the name of Src, when Pinger.ResolveNames is set and it
+	// has been looked up.
+	SrcName string
+
 	// NBytes is the number of bytes in the message.
 	Nbytes int
 
 	// Seq is the ICMP sequence number.
 	Seq int
 
+	// Size is the payload size of the echo request, which varies when
+	// Pinger sweeps sizes.
+	Size int
+
 	// TTL is the Time To Live on the packet.
 	TTL int
+
+	// TOS is the type of service, or traffic class for IPv6, of the
+	// packet, which shows whether the network remarked the DSCP bits.
+	TOS int
+
+	// Lost reports whether no reply was received within the timeout, or an
+	// ICMP error was received instead.
+	Lost bool
+
+	// Route is the addresses recorded in the reply's Record Route option,
+	// when Pinger.RecordRoute is set.
+	Route []net.IP
+
+	// Timestamps is the times recorded in the reply's Timestamp option,
+	// since midnight UT, when Pinger.Timestamp is set.
+	Timestamps []time.Duration
+
+	// Type is what the ICMP message received in response means, NoReply if
+	// there was none.
+	Type ReplyType
+
+	// ICMPType and ICMPCode are the type and code of the ICMP message
+	// received in response: an echo reply, or an error such as Destination
+	// Unreachable or Time Exceeded.
+	ICMPType int
+	ICMPCode int
+
+	// Err describes the ICMP error received in response, if any, as an
+	// *ICMPError.
+	Err error
+
+	// PatternMismatch reports whether the payload of the reply differs from
+	// the Pinger's Pattern, a hint at data-dependent corruption on the way.
+	PatternMismatch bool
+
+	// Truncated reports whether the reply echoed less of the payload than
+	// was sent.
+	Truncated bool
+
+	// Duplicate reports whether the packet is a duplicate reply to a
+	// request that was already answered.
+	Duplicate bool
+
+	// ClockStepped reports whether the clock went backwards between sending
+	// the request and receiving the reply. Rtt is zero then and left out of
+	// the statistics.
+	ClockStepped bool
+
+	// SentAt is the time the echo request was sent. For replies it is
+	// decoded from the echoed payload when that is large enough to carry it.
+	SentAt time.Time
+
+	// RecvAt is the time the reply was received, the zero time if there
+	// was none.
+	RecvAt time.Time
+
+	// payload is the echoed payload of a reply, in the read buffer, until
+	// it is handed to OnRawRecv.
+	payload []byte
+}
+
+// ReplyType is the meaning of the ICMP message received in response to an
+// echo request, the same for ICMP and ICMPv6.
+type ReplyType int
+
+const (
+	// NoReply means nothing came back, yet.
+	NoReply ReplyType = iota
+	// EchoReply is an echo reply from the target.
+	EchoReply
+	// TimeExceeded is a Time Exceeded error from a router on the way,
+	// whether the TTL or hop limit expired or reassembly timed out.
+	TimeExceeded
+	// DestUnreachable is a Destination Unreachable error.
+	DestUnreachable
+	// Other is any other error, such as ICMPv6 Packet Too Big.
+	Other
+)
+
+func (t ReplyType) String() string {
+	switch t {
+	case NoReply:
+		return "no reply"
+	case EchoReply:
+		return "echo reply"
+	case TimeExceeded:
+		return "time exceeded"
+	case DestUnreachable:
+		return "destination unreachable"
+	}
+	return "other"
+}
+
+// String returns p in the format of ping(8)'s per-packet output, e.g.
+//
+//	64 bytes from 1.1.1.1: icmp_seq=3 ttl=59 time=12.345 ms
+func (p *Packet) String() string {
+	from := p.Addr
+	switch {
+	case p.Src != nil && p.SrcName != "":
+		from = p.SrcName + " (" + p.Src.String() + ")"
+	case p.Src != nil:
+		from = p.Src.String()
+	case p.IPAddr != nil:
+		from = p.IPAddr.String()
+	}
+	switch {
+	case p.Err != nil:
+		return fmt.Sprintf("From %s: icmp_seq=%d %v", from, p.Seq, p.Err)
+	case p.Lost:
+		return fmt.Sprintf("Request timeout for icmp_seq %d", p.Seq)
+	}
+	str := fmt.Sprintf("%d bytes from %s: icmp_seq=%d ttl=%d time=%s ms",
+		p.Nbytes, from, p.Seq, p.TTL, formatRtt(p.Rtt))
+	if p.Duplicate {
+		str += " (DUP!)"
+	}
+	if p.Truncated {
+		str += " (truncated)"
+	}
+	if p.PatternMismatch {
+		str += " (wrong data)"
+	}
+	for i, ip := range p.Route {
+		if i == 0 {
+			str += "\nRR: "
+		} else {
+			str += "\n    "
+		}
+		str += "\t" + ip.String()
+	}
+	// like ping(8), the first timestamp is shown as is and the others
+	// relative to the one before
+	for i, ts := range p.Timestamps {
+		if i == 0 {
+			str += fmt.Sprintf("\nTS: \t%d absolute", ts.Milliseconds())
+		} else {
+			str += fmt.Sprintf("\n    \t%d", (ts - p.Timestamps[i-1]).Milliseconds())
+		}
+	}
+	return str
+}
+
+// formatRtt formats d in milliseconds to the microsecond, so that neither
+// LAN nor WAN round-trip times lose their sub-millisecond part.
+func formatRtt(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
 }
@@ -2,18 +2,106 @@ package ping
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"math"
+	mrand "math/rand"
 	"net"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	defaultSize = 56
+
+	// timestampLen is the size of the send time at the start of payloads
+	timestampLen = 8
+
+	// floodInterval is the longest Flood waits for a reply before sending
+	// the next request anyway
+	floodInterval = 10 * time.Millisecond
+
+	// floodMaxStored is the default MaxStored of Flood
+	floodMaxStored = 100000
+
+	// adaptiveMinInterval is the shortest Adaptive waits between requests,
+	// as for ping -A; unprivileged pingers must wait longer
+	adaptiveMinInterval             = 2 * time.Millisecond
+	adaptiveMinIntervalUnprivileged = 200 * time.Millisecond
+
+	// minRetryBackoff and maxRetryBackoff bound the wait between attempts
+	// to send a request with SendRetries
+	minRetryBackoff = 1 * time.Millisecond
+	maxRetryBackoff = 100 * time.Millisecond
 )
 
+// Logger is the interface verbose output is written to. *log.Logger
+// implements it, and most structured loggers provide an adapter.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 type Pinger struct {
 	laddr *net.IPAddr
 	raddr *net.IPAddr
 
+	// addr is the host being pinged, before resolution
+	addr string
+
+	// ipv4 reports whether raddr is an IPv4 address, otherwise ICMPv6 is used
+	ipv4 bool
+
+	// id is the ICMP echo identifier
+	id int
+
+	// conn is the socket shared by all pings of Run
+	conn icmpConn
+
+	// now returns the current time, used for timestamps and scheduling;
+	// tests use it to control the round-trip times
+	now func() time.Time
+
+	// dialer opens the sockets of Run and Ping in place of dial, if set;
+	// tests use it to exchange messages with a fake
+	dialer func() (icmpConn, error)
+
+	// lookupAddr looks up the names of ResolveNames in place of
+	// net.LookupAddr, if set
+	lookupAddr func(addr string) ([]string, error)
+
+	// names caches the names of the addresses replies came from, "" while
+	// the lookup is pending or if there is none
+	names   map[string]string
+	namesMu sync.Mutex
+
+	// awaiting holds the requests of Run still waiting for a reply, keyed
+	// by their 16-bit sequence number
+	awaiting map[int]request
+	awaitMu  sync.Mutex
+
+	// answered holds the requests of Run that got a reply, to tell
+	// duplicates apart
+	answered map[int]request
+
+	// replied is signaled by the receiver whenever a request is answered
+	replied chan struct{}
+
+	// packets is the channel returned by Packets
+	packets chan *Packet
+
 	// Count tells pinger to stop after sending (and receiving) Count echo
 	// packets. If this option is not specified, pinger will operate until
 	// interrupted.
@@ -22,13 +110,164 @@ type Pinger struct {
 	// Interval is the wait time between each packet send. Default is 1s.
 	Interval time.Duration
 
+	// IntervalJitter moves each request of Run by a random amount of up to
+	// IntervalJitter earlier or later than Interval has it, so that pingers
+	// started together don't keep probing in lockstep. The average interval
+	// stays Interval. It should be less than Interval, and has no effect on
+	// Flood. Default is 0.
+	IntervalJitter time.Duration
+
+	// Deadline stops Run once it has been running that long, however many
+	// packets are left to send, like ping -w. Default is 0, which means no
+	// limit.
+	Deadline time.Duration
+
 	// Timeout specifies a timeout before ping exits, regardless of how many
 	// packets have been received.
 	Timeout time.Duration
 
+	// MaxConsecutiveLoss stops Run once that many packets in a row were
+	// lost, and sets Statistics.LossLimitReached, e.g. to declare a host
+	// down. A reply starts the count over. Default is 0, which means no
+	// limit.
+	MaxConsecutiveLoss int
+
+	// WarmupCount leaves the round-trip times of the first replies out of
+	// the statistics, as those tend to include ARP or neighbor discovery
+	// and cold route caches. They are still counted as received and
+	// reported. Default is 0.
+	WarmupCount int
+
+	// SendRetries is how many times to retry sending an echo request that
+	// failed for a reason that tends to pass, such as ENOBUFS or the network
+	// being unreachable while an interface flaps. Retries back off
+	// exponentially from 1ms to 100ms and give up after Timeout. Default is
+	// 0, which reports the failure to OnError right away.
+	SendRetries int
+
+	// Flood sends the next echo request as soon as the previous one is
+	// answered, or after 10ms at most, ignoring Interval like ping -f. It
+	// requires a privileged pinger, and MaxStored defaults to 100000.
+	Flood bool
+
+	// Adaptive sends the next echo request as soon as the previous one is
+	// answered, so that the interval follows the round-trip time, like
+	// ping -A. Interval is still the longest wait between requests, and at
+	// least 2ms (200ms when unprivileged) pass between them.
+	Adaptive bool
+
+	// Size is the size of the echo payload in bytes. Default is 56, which
+	// makes for 64 byte ICMP packets.
+	Size int
+
+	// MinSize, MaxSize and SizeStep sweep the payload size, like ping -G:
+	// when SizeStep is set, each request carries SizeStep bytes more than
+	// the one before, from MinSize on, instead of Size, and Run stops once
+	// the next one would exceed MaxSize. With DontFragment set this shows
+	// where fragmentation or drops begin along the path.
+	MinSize  int
+	MaxSize  int
+	SizeStep int
+
+	// Pattern is the bytes the echo payload is filled with, repeated, like
+	// ping -p. Default is "Ping". Replies that don't echo it back are
+	// flagged with Packet.PatternMismatch.
+	Pattern []byte
+
+	// PayloadSeed, if not 0, fills the echo payload with pseudo-random
+	// bytes generated from it instead of Pattern, the same for every request
+	// and every run with the same seed. With Identifier set as well, two runs
+	// send byte-identical echo requests but for the sequence numbers and
+	// send times, so that their packet captures can be compared.
+	PayloadSeed int64
+
+	// TTL is the time to live, or hop limit for IPv6, of echo requests.
+	// Routers along the way report the request with an ICMP Time Exceeded
+	// message once it expires. Default is 0, which uses the system default.
+	TTL int
+
+	// TOS is the type of service, or traffic class for IPv6, of echo
+	// requests, e.g. a DSCP code point shifted left by two. It must be
+	// between 0 and 255. Default is 0.
+	TOS int
+
+	// RecordRoute asks every router on the way, and the target, to record
+	// its address in the IPv4 Record Route option of echo requests, like
+	// ping -R. The route comes back in Packet.Route, at most 9 hops. It
+	// needs a privileged IPv4 pinger on Linux.
+	RecordRoute bool
+
+	// Timestamp asks every router on the way, and the target, to record
+	// when it forwarded echo requests in the IPv4 Timestamp option, like
+	// ping -T tsonly. The times come back in Packet.Timestamps, at most 9 of
+	// them. Like RecordRoute, which it can't be combined with, it needs a
+	// privileged IPv4 pinger on Linux.
+	Timestamp bool
+
+	// DontFragment sets the Don't Fragment bit of echo requests, so that
+	// those too large for the path are answered with an ICMP error instead
+	// of being fragmented. It is only supported on Linux.
+	DontFragment bool
+
+	// Interface is the name of the network interface to send on, such as
+	// "eth1". Default is "", which leaves the choice to the routing table.
+	// It is only supported on Linux.
+	Interface string
+
+	// RecvBufferSize is the size in bytes of the receive buffer of the
+	// socket, SO_RCVBUF, so that replies coming in faster than they are
+	// read, as in Flood, aren't dropped and counted as lost. The kernel caps
+	// it, at net.core.rmem_max on Linux, and may double it for bookkeeping.
+	// Default is 0, which keeps the system default.
+	RecvBufferSize int
+
+	// MaxStored is the number of the most recent round-trip times kept for
+	// Statistics.Rtts and the percentiles, so that long runs don't grow
+	// without bound. Min, max, average, stddev and jitter still cover all
+	// packets. Default is 0, which keeps them all.
+	MaxStored int
+
+	// LossWindow is the number of the most recent requests that
+	// Statistics.RecentLoss covers, so that a monitor sees the loss right
+	// now rather than since Run started. Default is 0, which leaves
+	// RecentLoss at 0.
+	LossWindow int
+
 	// Verbose output each ping detail.
 	Verbose bool
 
+	// ControlConn, if set, is called with every socket Run and Ping open
+	// once the library has set its own options and before anything is sent
+	// on it, like net.Dialer.Control, so that callers can set options such
+	// as SO_RCVBUF or SO_MARK on the file descriptor. network is ip4:icmp
+	// or ip6:ipv6-icmp for raw sockets and udp4 or udp6 for unprivileged
+	// ones, address the target. An error closes the socket and fails the
+	// ping.
+	ControlConn func(network, address string, c syscall.RawConn) error
+
+	// Identifier is the ICMP echo identifier, e.g. to pick the pings out of
+	// a packet capture. Unprivileged sockets on Linux get it by binding to
+	// it as their port. Default is 0, which picks a random one. Unprivileged
+	// pingers running at once should keep to that: they can share an
+	// identifier, but then the kernel delivers each reply to only one of
+	// them.
+	Identifier int
+
+	// ResolveNames looks up the name of the address each reply comes from,
+	// for Packet.SrcName. Lookups run in the background and are cached, so
+	// the replies that come in while one is pending go without.
+	ResolveNames bool
+
+	// Logger receives the verbose output. Default is the standard logger of
+	// package log; nil discards it.
+	Logger Logger
+
+	// Privileged selects a raw ICMP socket, which requires root or
+	// CAP_NET_RAW. When false an unprivileged ICMP datagram socket is used
+	// instead, which is only supported on Linux and darwin. Defaults to the
+	// result of HasPrivilege.
+	Privileged bool
+
 	// Number of packets sent
 	PacketsSent int
 
@@ -38,19 +277,87 @@ type Pinger struct {
 	// Number of duplicate packets received
 	PacketsRecvDuplicates int
 
-	// Round trip time statistics
-	minRtt    time.Duration
-	maxRtt    time.Duration
-	avgRtt    time.Duration
-	stdDevRtt time.Duration
-	stddevm2  time.Duration
-	statsMu   sync.RWMutex
+	// Number of packets received after one sent later than them
+	PacketsOutOfOrder int
+
+	// Number of packets received with an invalid checksum, which are
+	// otherwise ignored
+	PacketsCorrupted int
+
+	// seq is the sequence number of the next echo request, which unlike
+	// PacketsSent survives Reset, as does warmedUp, the number of replies
+	// left out of the round-trip time statistics for WarmupCount
+	seq      int
+	warmedUp int
+
+	// maxSeqRecv is the highest sequence number received
+	maxSeqRecv int
+
+	// firstSent, lastSent and lastRecv are when the first and last echo
+	// requests were sent and the last reply received
+	firstSent time.Time
+	lastSent  time.Time
+	lastRecv  time.Time
+
+	// bytesSent and bytesRecv are the total size of the ICMP messages
+	// sent and received
+	bytesSent int
+	bytesRecv int
+
+	// round trip time statistics of the replies past the warmup
+	rtt rttStats
+
+	// outcomes holds what became of the requests from settled on that are
+	// known to have been answered or lost, until all those before them are
+	// too, so that loss streaks follow the order requests were sent in
+	// rather than the order their fate is known in
+	outcomes map[int]outcome
+	settled  int
+
+	// lossStreak is the number of requests lost in a row up to settled,
+	// maxLossStreak the longest streak seen, and lossLimitReached whether
+	// one reached MaxConsecutiveLoss
+	lossStreak       int
+	maxLossStreak    int
+	lossLimitReached bool
+
+	// recent holds whether each of the last LossWindow requests settled was
+	// lost, a ring buffer starting at recentStart once full, and recentLost
+	// how many of them were
+	recent      []bool
+	recentStart int
+	recentLost  int
+
+	// TTL statistics, 0 until a reply reports its TTL
+	minTTL  int
+	maxTTL  int
+	lastTTL int
+
+	statsMu sync.RWMutex
+
+	// rtts is the Rtts, a ring buffer starting at rttsStart once it holds
+	// maxStored of them
+	rtts      []time.Duration
+	rttsStart int
+
+	// running is set while Run is, atomically
+	running int32
 
-	// rtts is all of the Rtts
-	rtts []time.Duration
+	// readBufs counts the buffers allocated to read replies into,
+	// atomically, so that tests can check they are reused
+	readBufs int32
+
+	// wb is the buffer echo requests are built in, reused by send
+	wb   []byte
+	wbMu sync.Mutex
 
 	// is finished
-	finished bool
+	finished   bool
+	finishOnce sync.Once
+
+	// done is closed by Stop
+	done     chan struct{}
+	stopOnce sync.Once
 
 	// OnSetup is called when Pinger has finished setting up the listening socket
 	OnSetup func()
@@ -58,164 +365,1555 @@ type Pinger struct {
 	// OnSend is called when Pinger sends a packet
 	OnSend func(*Packet)
 
-	// OnLost is called when Pinger lost a packet
+	// OnLost is called when Pinger lost a packet: no reply came within
+	// Timeout, or an ICMP error such as Destination Unreachable came back
 	OnLost func(*Packet)
 
+	// OnError is called when Pinger fails for reasons other than the
+	// network losing a packet: the socket couldn't be opened, a request
+	// couldn't be sent, or a message received couldn't be parsed. seq is
+	// the sequence number of the request concerned, or -1 for none. A
+	// request that couldn't be sent still counts as sent, and so toward
+	// PacketLoss and RecentLoss, but OnLost isn't called for it.
+	OnError func(seq int, err error)
+
 	// OnRecv is called when Pinger receives and processes a packet
 	OnRecv func(*Packet)
 
+	// OnRawRecv is called with the payload echoed after the ICMP header of
+	// every reply, duplicates included, before OnRecv or OnDuplicate, for
+	// parsing data of one's own embedded in the requests. data is only
+	// valid until OnRawRecv returns.
+	OnRawRecv func(seq int, data []byte)
+
+	// OnDuplicate is called when Pinger receives a duplicate reply to a
+	// packet it already received
+	OnDuplicate func(*Packet)
+
+	// OnReorder is called when Pinger receives a reply to a packet sent
+	// before one it already received a reply to, which hints at
+	// load-balancing or multiple paths
+	OnReorder func(*Packet)
+
+	// OnTick is called once for every request of Run when its fate is
+	// known, whether it was answered, lost or couldn't be sent, in the order
+	// the requests were sent, with the statistics so far. It makes a single
+	// place to update a live display from.
+	OnTick func(seq int, s *Statistics)
+
 	// OnFinish is called when Pinger exits
 	OnFinish func(*Statistics)
 }
 
+// outcome is what became of an echo request.
+type outcome int8
+
+const (
+	answered outcome = iota
+	lost
+	unsent
+)
+
+// settle records the outcome of the request with sequence number seq and
+// follows the loss streak through that and every later request that is
+// settled already. It reports whether the streak reached
+// MaxConsecutiveLoss for the first time. The caller holds statsMu.
+func (p *Pinger) settle(seq int, o outcome) (limit bool) {
+	if seq < p.settled {
+		return false
+	}
+	if p.outcomes == nil {
+		p.outcomes = make(map[int]outcome)
+	}
+	p.outcomes[seq] = o
+	for {
+		next, ok := p.outcomes[p.settled]
+		if !ok {
+			return limit
+		}
+		delete(p.outcomes, p.settled)
+		p.settled++
+		p.addRecent(next != answered)
+		switch next {
+		case answered:
+			p.lossStreak = 0
+		case lost:
+			p.lossStreak++
+			if p.lossStreak > p.maxLossStreak {
+				p.maxLossStreak = p.lossStreak
+			}
+			if p.MaxConsecutiveLoss > 0 && p.lossStreak >= p.MaxConsecutiveLoss && !p.lossLimitReached {
+				p.lossLimitReached = true
+				limit = true
+			}
+		}
+	}
+}
+
+// addRecent records whether the request settled last was lost in the
+// window of RecentLoss. The caller holds statsMu.
+func (p *Pinger) addRecent(lost bool) {
+	if p.LossWindow <= 0 {
+		return
+	}
+	if len(p.recent) < p.LossWindow {
+		p.recent = append(p.recent, lost)
+	} else {
+		if p.recent[p.recentStart] {
+			p.recentLost--
+		}
+		p.recent[p.recentStart] = lost
+		p.recentStart = (p.recentStart + 1) % len(p.recent)
+	}
+	if lost {
+		p.recentLost++
+	}
+}
+
+// request is an echo request sent by Run.
+type request struct {
+	seq    int
+	sentAt time.Time
+}
+
 func (p *Pinger) updateStatistics(pkt *Packet) {
 	p.statsMu.Lock()
 	defer p.statsMu.Unlock()
 
 	p.PacketsRecv++
-	p.rtts = append(p.rtts, pkt.Rtt)
-
-	if p.PacketsRecv == 1 || pkt.Rtt < p.minRtt {
-		p.minRtt = pkt.Rtt
+	p.bytesRecv += pkt.Nbytes
+	if pkt.RecvAt.After(p.lastRecv) {
+		p.lastRecv = pkt.RecvAt
 	}
-
-	if pkt.Rtt > p.maxRtt {
-		p.maxRtt = pkt.Rtt
+	if pkt.TTL > 0 {
+		if p.minTTL == 0 || pkt.TTL < p.minTTL {
+			p.minTTL = pkt.TTL
+		}
+		if pkt.TTL > p.maxTTL {
+			p.maxTTL = pkt.TTL
+		}
+		p.lastTTL = pkt.TTL
+	}
+	if p.warmedUp < p.WarmupCount {
+		p.warmedUp++
+		return
+	}
+	if pkt.ClockStepped {
+		// the round-trip time is meaningless, keep it out of the statistics
+		return
 	}
 
-	pktCount := time.Duration(p.PacketsRecv)
-	// welford's online method for stddev
-	// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-	delta := pkt.Rtt - p.avgRtt
-	p.avgRtt += delta / pktCount
-	delta2 := pkt.Rtt - p.avgRtt
-	p.stddevm2 += delta * delta2
-
-	p.stdDevRtt = time.Duration(math.Sqrt(float64(p.stddevm2 / pktCount)))
+	p.rtt.add(pkt.Rtt)
+	if max := p.maxStored(); max > 0 && len(p.rtts) >= max {
+		p.rtts[p.rttsStart] = pkt.Rtt
+		p.rttsStart = (p.rttsStart + 1) % len(p.rtts)
+	} else {
+		p.rtts = append(p.rtts, pkt.Rtt)
+	}
 }
 
 func (p *Pinger) Statistics() *Statistics {
 	p.statsMu.RLock()
 	defer p.statsMu.RUnlock()
-	sent := p.PacketsSent
-	loss := float64(sent-p.PacketsRecv) / float64(sent) * 100
+	snap := p.snapshot()
+	// p.rtts keeps changing while Run is going, hand out a copy, oldest
+	// first
+	rtts := make([]time.Duration, 0, len(p.rtts))
+	rtts = append(rtts, p.rtts[p.rttsStart:]...)
+	rtts = append(rtts, p.rtts[:p.rttsStart]...)
 	s := Statistics{
-		PacketsSent:           sent,
-		PacketsRecv:           p.PacketsRecv,
-		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
-		PacketLoss:            loss,
-		Rtts:                  p.rtts,
+		PacketsSent:           snap.PacketsSent,
+		PacketsRecv:           snap.PacketsRecv,
+		PacketsRecvDuplicates: snap.PacketsRecvDuplicates,
+		PacketsOutOfOrder:     p.PacketsOutOfOrder,
+		PacketsCorrupted:      p.PacketsCorrupted,
+		PacketLoss:            snap.PacketLoss,
+		Rtts:                  rtts,
 		LocalIP:               p.laddr.String(),
 		RemoteIP:              p.raddr.String(),
-		MaxRtt:                p.maxRtt,
-		MinRtt:                p.minRtt,
-		AvgRtt:                p.avgRtt,
-		StdDevRtt:             p.stdDevRtt,
+		MaxRtt:                snap.MaxRtt,
+		MinRtt:                snap.MinRtt,
+		AvgRtt:                snap.AvgRtt,
+		RttCount:              snap.RttCount,
+		StdDevRtt:             snap.StdDevRtt,
+		PopStdDevRtt:          snap.PopStdDevRtt,
+		Jitter:                snap.Jitter,
+		BytesSent:             p.bytesSent,
+		BytesRecv:             p.bytesRecv,
+		MinTTL:                p.minTTL,
+		MaxTTL:                p.maxTTL,
+		LastTTL:               p.lastTTL,
+		LossLimitReached:      p.lossLimitReached,
+		MaxLossStreak:         p.maxLossStreak,
+	}
+	if len(p.recent) > 0 {
+		s.RecentLoss = float64(p.recentLost) / float64(len(p.recent)) * 100
 	}
+	if snap.PacketsSent > 0 {
+		end := p.lastSent
+		if p.lastRecv.After(end) {
+			end = p.lastRecv
+		}
+		s.Duration = end.Sub(p.firstSent)
+	}
+	s.setPercentiles(rtts)
 	return &s
 }
 
-func NewPinger(localIP, remoteIP string, timeout time.Duration, count int) *Pinger {
-	laddr := net.IPAddr{IP: net.ParseIP(localIP)}
-	raddr := net.IPAddr{IP: net.ParseIP(remoteIP)}
+// Snapshot returns the counters and round-trip time statistics so far. It
+// is cheaper than Statistics, which copies every round-trip time, for
+// callers polling several times a second.
+func (p *Pinger) Snapshot() StatSnapshot {
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+	return p.snapshot()
+}
+
+// snapshot returns the statistics of Snapshot; the caller holds statsMu.
+func (p *Pinger) snapshot() StatSnapshot {
+	s := StatSnapshot{
+		PacketsSent:           p.PacketsSent,
+		PacketsRecv:           p.PacketsRecv,
+		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
+	}
+	if p.PacketsSent > 0 && p.PacketsRecv < p.PacketsSent {
+		s.PacketLoss = float64(p.PacketsSent-p.PacketsRecv) / float64(p.PacketsSent) * 100
+	}
+	p.rtt.fill(&s)
+	return s
+}
+
+// NewPinger returns a Pinger for remote, which may be an IP address or a
+// hostname. If remote can't be resolved every ping will fail; use NewPingerE
+// to get the error up front.
+func NewPinger(localIP, remote string, timeout time.Duration, count int) *Pinger {
+	p, err := NewPingerE(localIP, remote, timeout, count)
+	if err != nil {
+		laddr := net.IPAddr{IP: net.ParseIP(localIP)}
+		return newPinger(&laddr, &net.IPAddr{}, remote, timeout, count)
+	}
+	return p
+}
+
+// NewPingerE is like NewPinger but validates its arguments: localIP must be
+// empty or an IP address, remote an IP address or a resolvable hostname of
+// the same family as localIP (unless localIP is unspecified), and timeout
+// must be positive.
+func NewPingerE(localIP, remote string, timeout time.Duration, count int) (*Pinger, error) {
+	return New(remote, WithSource(localIP), WithTimeout(timeout), WithCount(count))
+}
+
+func newPinger(laddr, raddr *net.IPAddr, addr string, timeout time.Duration, count int) *Pinger {
 	return &Pinger{
 		Interval: 1 * time.Second,
+		Size:     defaultSize,
 
-		laddr:   &laddr,
-		raddr:   &raddr,
+		laddr:   laddr,
+		raddr:   raddr,
+		addr:    addr,
+		ipv4:    raddr.IP.To4() != nil,
+		id:      newID(),
 		Timeout: timeout,
 		Count:   count,
+
+		Privileged: HasPrivilege(),
+		Logger:     log.Default(),
+
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+}
+
+// newID returns a random ICMP echo identifier, so that pingers sharing a
+// process (or a pid) don't pick up each other's replies.
+func newID() int {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return os.Getpid() & 0xffff
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+// resolve looks up host, preferring an address of the same family as the
+// local address if one was given.
+func resolve(local net.IP, host string) (*net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.IPAddr{IP: ip}, nil
+	}
+	network := "ip"
+	if local != nil && !local.IsUnspecified() {
+		if local.To4() != nil {
+			network = "ip4"
+		} else {
+			network = "ip6"
+		}
+	}
+	return net.ResolveIPAddr(network, host)
+}
+
+// resolve looks up host and makes it the target of p.
+func (p *Pinger) resolve(host string) error {
+	raddr, err := resolve(p.laddr.IP, host)
+	if err != nil {
+		return err
+	}
+	ipv4 := raddr.IP.To4() != nil
+	if ip := p.laddr.IP; ip != nil && !ip.IsUnspecified() && (ip.To4() != nil) != ipv4 {
+		return fmt.Errorf("local address %s and remote address %s are of different families", ip, raddr.IP)
 	}
+	p.raddr, p.addr, p.ipv4 = raddr, host, ipv4
+	return nil
+}
+
+// Addr returns the host being pinged, as given to NewPinger.
+func (p *Pinger) Addr() string {
+	return p.addr
 }
 
+// IPAddr returns the resolved address of the host being pinged.
+func (p *Pinger) IPAddr() *net.IPAddr {
+	return p.raddr
+}
+
+// SetTarget resolves host and makes it the target of p, so that a Pinger
+// can be reused for another host. The statistics gathered so far are
+// cleared and p can be Run again. SetTarget must not be called while p is
+// running.
+func (p *Pinger) SetTarget(host string) error {
+	if err := p.resolve(host); err != nil {
+		return err
+	}
+	p.Reset()
+	p.seq, p.warmedUp = 0, 0
+	p.outcomes, p.settled = nil, 0
+
+	// re-arm Run, the socket sends to the old target so it goes
+	p.conn = nil
+	p.packets = nil
+	p.finished = false
+	p.finishOnce = sync.Once{}
+	p.done = make(chan struct{})
+	p.stopOnce = sync.Once{}
+	return nil
+}
+
+// Reset clears the counters and round-trip time statistics, e.g. to report
+// them per minute. It may be called while p is running; replies to requests
+// sent before the Reset are then counted as received but not as sent.
+func (p *Pinger) Reset() {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	p.PacketsSent = 0
+	p.PacketsRecv = 0
+	p.PacketsRecvDuplicates = 0
+	p.PacketsOutOfOrder = 0
+	p.PacketsCorrupted = 0
+	p.maxSeqRecv = 0
+	p.firstSent, p.lastSent, p.lastRecv = time.Time{}, time.Time{}, time.Time{}
+	p.bytesSent, p.bytesRecv = 0, 0
+	p.rtt = rttStats{}
+	p.minTTL, p.maxTTL, p.lastTTL = 0, 0, 0
+	p.lossStreak, p.maxLossStreak, p.lossLimitReached = 0, 0, false
+	p.recent, p.recentStart, p.recentLost = nil, 0, 0
+	p.rtts, p.rttsStart = nil, 0
+}
+
+// Run runs the pinger until Count packets have been sent, then calls Finish.
 func (p *Pinger) Run() {
+	p.RunContext(context.Background())
+}
+
+// RunContext is like Run but also stops as soon as ctx is done, in which
+// case ctx.Err() is returned.
+//
+// Echo requests are sent every Interval regardless of whether the previous
+// one has been answered, while a separate goroutine reads the replies.
+// A request is reported lost once it has waited Timeout for its reply.
+//
+// A Pinger runs once: RunContext returns an error if it is running already
+// in another goroutine, and nil right away once it has finished, unless
+// SetTarget re-arms it.
+func (p *Pinger) RunContext(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return errRunning
+	}
+	defer atomic.StoreInt32(&p.running, 0)
 	if p.finished {
-		return
+		return nil
 	}
 	defer p.Finish()
-	ping := func(seq int) {
-		var isLost = false
-		err, packet := p.Ping(seq)
-		if err != nil {
-			isLost = true
-			handler := p.OnLost
-			if handler != nil {
-				handler(&packet)
+	if p.Flood && !p.Privileged {
+		return errFloodUnprivileged
+	}
+	if err := p.listen(); err != nil {
+		p.handleError(-1, err)
+		return err
+	}
+	handler := p.OnSetup
+	if handler != nil {
+		handler()
+	}
+	p.awaiting = make(map[int]request)
+	p.answered = make(map[int]request)
+	p.replied = make(chan struct{}, 1)
+
+	var recvErr error
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		recvErr = p.recvLoop()
+	}()
+	err := p.sendLoop(ctx, recvDone)
+	p.conn.Close()
+	<-recvDone
+	if err == nil && !errors.Is(recvErr, net.ErrClosed) {
+		// the receiver failed before we were done
+		err = recvErr
+		p.handleError(-1, err)
+	}
+	return err
+}
+
+// sendLoop sends the echo requests of Run at Interval cadence and expires
+// those left unanswered for longer than Timeout. It returns once every
+// request has been answered or expired, when ctx or the receiver is done,
+// when Deadline passes or when Stop is called.
+func (p *Pinger) sendLoop(ctx context.Context, recvDone <-chan struct{}) error {
+	remaining := p.Count
+	var last time.Time
+	next := p.now()
+	var deadline <-chan time.Time
+	if p.Deadline > 0 {
+		t := time.NewTimer(p.Deadline)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+		now := p.now()
+		if now.Before(last) {
+			// the clock was stepped back, move the schedule with it
+			// rather than wait out the step
+			step := last.Sub(now)
+			last, next = now, next.Add(-step)
+		}
+		if remaining != 0 && (p.Flood || p.Adaptive) && p.idle() {
+			// the previous request was answered, don't wait out the
+			// interval
+			if early := last.Add(p.minInterval()); early.Before(next) {
+				next = early
 			}
-		} else {
-			handler := p.OnRecv
-			if handler != nil {
-				handler(&packet)
+		}
+		if remaining != 0 && p.swept() {
+			remaining = 0
+		}
+		if remaining != 0 && !now.Before(next) {
+			if remaining > 0 {
+				remaining--
+			}
+			p.sendNext(now)
+			last = now
+			// keep to the schedule rather than counting from now, which
+			// is late by however long the timer and the send took, unless
+			// a whole interval was missed
+			d := p.nextInterval()
+			if next = next.Add(d); !next.After(now) {
+				next = now.Add(d)
 			}
-			p.updateStatistics(&packet)
 		}
-		if p.Verbose {
-			if isLost {
-				log.Printf("lost seq=%d timeout=%ds", p.PacketsSent, p.Timeout.Milliseconds())
-			} else {
-				log.Printf("pong seq=%d time=%dms ttl=%v size=%dbyte", p.PacketsSent, packet.Rtt.Milliseconds(), packet.TTL, packet.Nbytes)
+		oldest := p.expire(now)
+		if remaining == 0 && oldest.IsZero() {
+			return nil
+		}
+
+		wait := time.Duration(math.MaxInt64)
+		if remaining != 0 {
+			wait = next.Sub(now)
+		}
+		if !oldest.IsZero() {
+			if d := oldest.Add(p.Timeout).Sub(now); d < wait {
+				wait = d
 			}
 		}
-		p.PacketsSent++
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-recvDone:
+			t.Stop()
+			return nil
+		case <-p.done:
+			t.Stop()
+			return nil
+		case <-deadline:
+			t.Stop()
+			return nil
+		case <-p.replied:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// maxStored returns the number of Rtts to keep, or 0 for all of them.
+func (p *Pinger) maxStored() int {
+	if p.MaxStored == 0 && p.Flood {
+		return floodMaxStored
+	}
+	return p.MaxStored
+}
+
+// interval returns the longest wait between two echo requests of Run.
+func (p *Pinger) interval() time.Duration {
+	if p.Flood {
+		return floodInterval
+	}
+	return p.Interval
+}
+
+// nextInterval returns the interval to the next echo request of Run, moved
+// by IntervalJitter at random.
+func (p *Pinger) nextInterval() time.Duration {
+	d := p.interval()
+	if p.IntervalJitter <= 0 || p.Flood {
+		return d
+	}
+	d += time.Duration(mrand.Int63n(2*int64(p.IntervalJitter)+1)) - p.IntervalJitter
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// minInterval returns the shortest wait between two echo requests of Run in
+// Flood or Adaptive mode.
+func (p *Pinger) minInterval() time.Duration {
+	switch {
+	case p.Flood:
+		return 0
+	case !p.Privileged:
+		return adaptiveMinIntervalUnprivileged
+	}
+	return adaptiveMinInterval
+}
+
+// idle reports whether every request sent by Run was answered or expired.
+func (p *Pinger) idle() bool {
+	p.awaitMu.Lock()
+	defer p.awaitMu.Unlock()
+	return len(p.awaiting) == 0
+}
+
+// sendNext sends the next echo request on the shared socket and records it
+// as awaiting a reply.
+func (p *Pinger) sendNext(now time.Time) {
+	seq := p.countSent(now)
+	sentAt := now
+	backoff := minRetryBackoff
+	for retries := 0; ; retries++ {
+		// hold the lock until OnSend returns, so that the receiver can't
+		// report the reply before the request
+		p.awaitMu.Lock()
+		err := p.send(p.conn, seq, sentAt)
+		if err == nil {
+			break
+		}
+		p.awaitMu.Unlock()
+		if retries >= p.SendRetries || !transient(err) || p.now().Add(backoff).Sub(now) >= p.Timeout {
+			p.handleError(seq, err)
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		sentAt = p.now()
+	}
+	p.awaiting[seq&0xffff] = request{seq: seq, sentAt: sentAt}
+	delete(p.answered, seq&0xffff)
+	handler := p.OnSend
+	if handler != nil {
+		handler(&Packet{IPAddr: p.raddr, Addr: p.addr, Seq: seq, Size: p.size(seq), SentAt: sentAt})
+	}
+	p.awaitMu.Unlock()
+}
+
+// transient reports whether sending failed for a reason that may pass by
+// itself, so that it is worth retrying.
+func transient(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.EAGAIN)
+}
+
+// size returns the payload size of the echo request with sequence number
+// seq: Size, or where the sweep is at.
+func (p *Pinger) size(seq int) int {
+	if p.SizeStep <= 0 {
+		return p.Size
 	}
-	for count := p.Count; count != 0; {
-		if count > 0 {
-			count--
+	return p.MinSize + seq*p.SizeStep
+}
+
+// swept reports whether a size sweep has reached MaxSize.
+func (p *Pinger) swept() bool {
+	if p.SizeStep <= 0 {
+		return false
+	}
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+	return p.size(p.seq) > p.MaxSize
+}
+
+// countSent counts an echo request sent at now in the statistics, and
+// returns its sequence number.
+func (p *Pinger) countSent(now time.Time) int {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	if p.PacketsSent == 0 {
+		p.firstSent = now
+	}
+	p.lastSent = now
+	seq := p.seq
+	p.bytesSent += 8 + p.size(seq)
+	p.seq++
+	p.PacketsSent++
+	return seq
+}
+
+// expire reports the requests that have waited longer than Timeout for a
+// reply as lost, and returns the send time of the oldest request still
+// awaiting one, or the zero time if there is none.
+func (p *Pinger) expire(now time.Time) (oldest time.Time) {
+	var lost []request
+	p.awaitMu.Lock()
+	for xseq, req := range p.awaiting {
+		if now.Sub(req.sentAt) >= p.Timeout {
+			lost = append(lost, req)
+			delete(p.awaiting, xseq)
+		} else if oldest.IsZero() || req.sentAt.Before(oldest) {
+			oldest = req.sentAt
 		}
-		ping(p.PacketsSent)
-		time.Sleep(p.Interval)
 	}
-	return
+	p.awaitMu.Unlock()
+
+	sort.Slice(lost, func(i, j int) bool { return lost[i].seq < lost[j].seq })
+	for _, req := range lost {
+		p.handleLost(&Packet{IPAddr: p.raddr, Addr: p.addr, Seq: req.seq, Size: p.size(req.seq), SentAt: req.sentAt})
+	}
+	return oldest
 }
 
-func (p *Pinger) Ping(seq int) (err error, packet Packet) {
-	packet.Seq = seq
-	start := time.Now()
-	c, err := net.DialIP("ip4:icmp", p.laddr, p.raddr)
-	if err != nil {
+// recvLoop reads the replies to the requests of Run from the shared socket
+// until it is closed.
+func (p *Pinger) recvLoop() error {
+	rb := p.readBuffer()
+	defer putReadBuffer(rb)
+	for {
+		packet, _, err := p.recv(p.conn, rb.b, rb.oob[:])
+		if err != nil {
+			return err
+		}
+		received := p.now()
+		p.awaitMu.Lock()
+		req, ok := p.awaiting[packet.Seq]
+		if ok {
+			delete(p.awaiting, packet.Seq)
+			if packet.Err == nil {
+				p.answered[packet.Seq] = req
+			}
+		} else if packet.Err == nil {
+			req, packet.Duplicate = p.answered[packet.Seq]
+		}
+		p.awaitMu.Unlock()
+		if !ok && !packet.Duplicate {
+			// a late reply to a request that already expired
+			continue
+		}
+		packet.Seq = req.seq
+		roundTrip(&packet, req.sentAt, received)
+		switch {
+		case packet.Duplicate:
+			p.handleDuplicate(&packet)
+			continue
+		case packet.Err != nil:
+			p.handleLost(&packet)
+		default:
+			p.handleRecv(&packet)
+		}
+		select {
+		case p.replied <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *Pinger) handleRecv(packet *Packet) {
+	p.statsMu.Lock()
+	reordered := p.PacketsRecv > 0 && packet.Seq < p.maxSeqRecv
+	if reordered {
+		p.PacketsOutOfOrder++
+	} else {
+		p.maxSeqRecv = packet.Seq
+	}
+	from := p.settled
+	limit := p.settle(packet.Seq, answered)
+	to := p.settled
+	p.statsMu.Unlock()
+	if limit {
+		p.Stop()
+	}
+	p.rawRecv(packet)
+	if handler := p.OnReorder; reordered && handler != nil {
+		handler(packet)
+	}
+	handler := p.OnRecv
+	if handler != nil {
+		handler(packet)
+	}
+	p.updateStatistics(packet)
+	p.emit(packet)
+	if p.Verbose {
+		p.logf("%v", packet)
+	}
+	p.tick(from, to)
+}
+
+// logf writes a line of verbose output to the Logger, if any.
+func (p *Pinger) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+	}
+}
+
+// emit sends a copy of packet to the channel returned by Packets, if any.
+func (p *Pinger) emit(packet *Packet) {
+	if p.packets != nil {
+		pkt := *packet
+		p.packets <- &pkt
+	}
+}
+
+// Packets returns a channel on which Run sends every received and lost
+// packet, in addition to calling OnRecv or OnLost. It is closed by Finish.
+// Packets must be called before Run, and the channel must be drained for
+// Run to make progress.
+func (p *Pinger) Packets() <-chan *Packet {
+	if p.packets == nil {
+		p.packets = make(chan *Packet, 16)
+	}
+	return p.packets
+}
+
+func (p *Pinger) handleDuplicate(packet *Packet) {
+	p.statsMu.Lock()
+	p.PacketsRecvDuplicates++
+	p.statsMu.Unlock()
+	p.rawRecv(packet)
+	handler := p.OnDuplicate
+	if handler != nil {
+		handler(packet)
+	}
+	if p.Verbose {
+		p.logf("%v", packet)
+	}
+}
+
+// rawRecv hands the payload of packet to OnRawRecv. It lives in the read
+// buffer, which the next message overwrites, so packet lets go of it.
+func (p *Pinger) rawRecv(packet *Packet) {
+	if handler := p.OnRawRecv; handler != nil {
+		handler(packet.Seq, packet.payload)
+	}
+	packet.payload = nil
+}
+
+func (p *Pinger) handleLost(packet *Packet) {
+	packet.Lost = true
+	p.statsMu.Lock()
+	from := p.settled
+	limit := p.settle(packet.Seq, lost)
+	to := p.settled
+	p.statsMu.Unlock()
+	if limit {
+		p.Stop()
+	}
+	handler := p.OnLost
+	if handler != nil {
+		handler(packet)
+	}
+	p.emit(packet)
+	if p.Verbose {
+		p.logf("%v", packet)
+	}
+	p.tick(from, to)
+}
+
+func (p *Pinger) handleError(seq int, err error) {
+	var from, to int
+	if seq >= 0 {
+		p.statsMu.Lock()
+		from = p.settled
+		p.settle(seq, unsent)
+		to = p.settled
+		p.statsMu.Unlock()
+	}
+	handler := p.OnError
+	if handler != nil {
+		handler(seq, err)
+	}
+	if p.Verbose {
+		if seq < 0 {
+			p.logf("error: %v", err)
+		} else {
+			p.logf("error icmp_seq=%d: %v", seq, err)
+		}
+	}
+	p.tick(from, to)
+}
+
+// tick calls OnTick for the requests from from up to to that were settled.
+// They all settled at once, so they share the statistics, which are costly
+// to build with many round-trip times stored.
+func (p *Pinger) tick(from, to int) {
+	handler := p.OnTick
+	if handler == nil || from >= to {
 		return
 	}
-	c.SetDeadline(time.Now().Add(p.Timeout))
-	defer c.Close()
+	s := p.Statistics()
+	for seq := from; seq < to; seq++ {
+		handler(seq, s)
+	}
+}
 
-	typ := icmpv4EchoRequest
-	xid, xseq := os.Getpid()&0xffff, 1
-	wb, err := (&icmpMessage{
-		Type: typ, Code: 0, SequenceNum: seq & 0xffff,
-		Body: &icmpEcho{
-			ID: xid, Seq: xseq,
-			Data: bytes.Repeat([]byte("Ping"), 3),
-		},
-	}).Marshal()
+// Ping sends a single echo request with sequence number seq on a socket of
+// its own and waits up to Timeout for the reply.
+func (p *Pinger) Ping(seq int) (packet Packet, err error) {
+	return p.ping(context.Background(), seq)
+}
+
+// Reachable sends a single echo request to host and returns the round-trip
+// time of the reply, or an error if there is none within timeout.
+func Reachable(host string, timeout time.Duration) (time.Duration, error) {
+	p, err := New(host, WithTimeout(timeout))
+	if err != nil {
+		return 0, err
+	}
+	packet, err := p.Ping(0)
+	if err != nil {
+		return 0, err
+	}
+	return packet.Rtt, nil
+}
+
+// checkAllWorkers is how many hosts CheckAll and PingCIDR ping at once,
+// each with a socket of its own.
+const checkAllWorkers = 32
+
+// CheckAll pings each of hosts once, a few at a time, and reports which of
+// them replied within timeout. Hosts that can't be resolved, and those left
+// when ctx is done, are reported down.
+func CheckAll(ctx context.Context, hosts []string, timeout time.Duration) map[string]bool {
+	up := make(map[string]bool, len(hosts))
+	var mu sync.Mutex
+	forEach(ctx, hosts, func(host string) {
+		ok := false
+		if p, err := New(host, WithTimeout(timeout)); err == nil {
+			_, err = p.ping(ctx, 0)
+			ok = err == nil
+		}
+		mu.Lock()
+		up[host] = ok
+		mu.Unlock()
+	})
+	for _, host := range hosts {
+		if _, ok := up[host]; !ok {
+			up[host] = false
+		}
+	}
+	return up
+}
+
+// cidrMaxHosts is the most addresses PingCIDR sweeps, e.g. a /16.
+const cidrMaxHosts = 1 << 16
+
+// PingCIDR pings every host address of the network cidr, such as
+// 192.168.1.0/24, once, a few at a time like CheckAll, and returns the
+// statistics of each by address: PacketsRecv is 1 for those that replied
+// within timeout. The network and broadcast addresses of IPv4 networks are
+// skipped, as is the Subnet-Router anycast address of IPv6 ones. Networks of
+// more than 65536 addresses are refused.
+func PingCIDR(cidr string, timeout time.Duration) (map[string]*Statistics, error) {
+	hosts, err := cidrHosts(cidr)
+	if err != nil {
+		return nil, err
+	}
+	// New can only fail on the timeout for an IP address, don't let that
+	// pass for every host being down
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout %v", timeout)
+	}
+	stats := make(map[string]*Statistics, len(hosts))
+	var mu sync.Mutex
+	forEach(context.Background(), hosts, func(host string) {
+		p, err := New(host, WithTimeout(timeout), WithCount(1))
+		if err != nil {
+			return
+		}
+		p.Logger = nil
+		p.RunContext(context.Background())
+		mu.Lock()
+		stats[host] = p.Statistics()
+		mu.Unlock()
+	})
+	return stats, nil
+}
+
+// cidrHosts returns the host addresses of the network cidr, in order.
+func cidrHosts(cidr string) ([]string, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("network %s has more than %d addresses", cidr, cidrMaxHosts)
+	}
+	n := 1 << (bits - ones)
+	first, last := 0, n-1
+	switch {
+	case ip.To4() != nil && n > 2:
+		// network and broadcast addresses
+		first, last = 1, n-2
+	case ip.To4() == nil && n > 1:
+		// Subnet-Router anycast address
+		first = 1
+	}
+	hosts := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		addr := make(net.IP, len(ipnet.IP))
+		copy(addr, ipnet.IP)
+		for j, k := len(addr)-1, i; k > 0; j, k = j-1, k>>8 {
+			addr[j] |= byte(k)
+		}
+		hosts = append(hosts, addr.String())
+	}
+	return hosts, nil
+}
+
+// forEach calls f with each of hosts, on checkAllWorkers goroutines, until
+// ctx is done.
+func forEach(ctx context.Context, hosts []string, f func(host string)) {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < checkAllWorkers && i < len(hosts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range work {
+				f(host)
+			}
+		}()
+	}
+feed:
+	for _, host := range hosts {
+		select {
+		case work <- host:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (p *Pinger) ping(ctx context.Context, seq int) (packet Packet, err error) {
+	start := p.now()
+	c, err := p.open()
 	if err != nil {
 		return
 	}
-	if _, err = c.Write(wb); err != nil {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.Timeout))
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				// a deadline in the past unblocks any pending read or write
+				c.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+	}
+
+	if err = p.send(c, seq, start); err != nil {
 		return
 	}
-	var m *icmpMessage
-	rb := make([]byte, 20+len(wb))
+	rb := p.readBuffer()
+	defer putReadBuffer(rb)
 	for {
-		if _, err = c.Read(rb); err != nil {
+		if packet, _, err = p.recv(c, rb.b, rb.oob[:]); err != nil {
+			packet = Packet{IPAddr: p.raddr, Addr: p.addr, Seq: seq}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			} else {
+				err = classify(err)
+			}
 			return
 		}
-		packet.TTL = int(rb[8])
-		rb = ipv4Payload(rb)
-		packet.Nbytes = len(rb)
-		if m, err = parseICMPMessage(rb); err != nil {
+		if packet.Seq == seq&0xffff {
+			break
+		}
+	}
+	received := p.now()
+	packet.Seq = seq
+	roundTrip(&packet, start, received)
+	err = packet.Err
+	return
+}
+
+// roundTrip sets the send and receive times and the round-trip time of a
+// reply to a request sent at sent. The round-trip time is measured from
+// sent, which keeps its monotonic reading, not from the wall time decoded
+// from the payload; should it still come out negative, the clock was stepped
+// back, and it is clamped to zero and flagged.
+func roundTrip(pkt *Packet, sent, received time.Time) {
+	pkt.SentAt = sentTime(pkt.SentAt, sent, received)
+	pkt.RecvAt = received
+	pkt.Rtt = received.Sub(sent)
+	if pkt.Rtt < 0 {
+		pkt.Rtt = 0
+		pkt.ClockStepped = true
+	}
+}
+
+// sentTime returns the send time embedded in a reply received at received,
+// or fallback if there is none or it lies in the future, meaning the clock
+// was stepped back since.
+func sentTime(embedded, fallback, received time.Time) time.Time {
+	if embedded.IsZero() || embedded.After(received) {
+		return fallback
+	}
+	return embedded
+}
+
+// data returns the payload of an echo request sent at now, as putData
+// fills it.
+func (p *Pinger) data(now time.Time, size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	b := make([]byte, size)
+	p.putData(b, now)
+	return b
+}
+
+// putData fills the payload b of an echo request sent at now: Pattern, or
+// "Ping", repeated, after the send time in nanoseconds if there is room for
+// it.
+func (p *Pinger) putData(b []byte, now time.Time) {
+	if len(b) >= timestampLen {
+		binary.BigEndian.PutUint64(b, uint64(now.UnixNano()))
+	}
+	p.fill(b)
+}
+
+// fill fills the payload b, after the send time if there is room for it,
+// with the repeated pattern, or the bytes of PayloadSeed.
+func (p *Pinger) fill(b []byte) {
+	if len(b) >= timestampLen {
+		b = b[timestampLen:]
+	}
+	if p.PayloadSeed != 0 {
+		for i := range b {
+			b[i] = seededByte(p.PayloadSeed, i)
+		}
+		return
+	}
+	pattern := p.Pattern
+	if len(pattern) == 0 {
+		pattern = []byte("Ping")
+	}
+	for i := range b {
+		b[i] = pattern[i%len(pattern)]
+	}
+}
+
+// seededByte returns byte i of the payload generated from seed, with
+// SplitMix64 so that it takes no state.
+func seededByte(seed int64, i int) byte {
+	z := uint64(seed) + uint64(i/8+1)*0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return byte(z >> (8 * (i % 8)))
+}
+
+// patternMatches reports whether the echoed payload b carries the pattern
+// data sent, as far as it goes.
+func (p *Pinger) patternMatches(b []byte) bool {
+	want := make([]byte, len(b))
+	copy(want, b)
+	p.fill(want)
+	return bytes.Equal(b, want)
+}
+
+// bufferSize returns the size of the buffer needed to read a reply: room
+// for a typical MTU, so that neither IP options nor error messages quoting
+// a request cut it short, or for a reply to Size bytes of payload.
+func (p *Pinger) bufferSize() int {
+	const minSize = 1500
+	// an IPv4 header is up to 60 bytes with options such as Record Route
+	size := p.Size
+	if p.SizeStep > 0 && p.MaxSize > size {
+		size = p.MaxSize
+	}
+	if size := 60 + 8 + size; size > minSize {
+		return size
+	}
+	return minSize
+}
+
+// readBuf is a buffer to read replies into, along with their control
+// messages.
+type readBuf struct {
+	b   []byte
+	oob [64]byte
+}
+
+// readBufPool holds the readBufs of pingers done with them, so that
+// pingers pinging one after the other don't each allocate their own.
+var readBufPool sync.Pool
+
+// readBuffer returns a readBuf of bufferSize, from readBufPool if one there
+// is large enough, to be returned with putReadBuffer.
+func (p *Pinger) readBuffer() *readBuf {
+	size := p.bufferSize()
+	if rb, ok := readBufPool.Get().(*readBuf); ok && cap(rb.b) >= size {
+		rb.b = rb.b[:size]
+		return rb
+	}
+	atomic.AddInt32(&p.readBufs, 1)
+	return &readBuf{b: make([]byte, size)}
+}
+
+// putReadBuffer returns rb to readBufPool. rb must not be used afterwards;
+// packets read into it copy what they keep.
+func putReadBuffer(rb *readBuf) {
+	readBufPool.Put(rb)
+}
+
+// send writes an echo request with sequence number seq, sent at now, to c.
+// The request is built in a buffer kept from one request to the next.
+func (p *Pinger) send(c icmpConn, seq int, now time.Time) error {
+	p.wbMu.Lock()
+	defer p.wbMu.Unlock()
+	p.wb = p.appendEchoRequest(p.wb[:0], seq, now)
+	_, err := c.Write(p.wb)
+	return classify(err)
+}
+
+// echoRequest returns the echo request with sequence number seq, sent at now.
+func (p *Pinger) echoRequest(seq int, now time.Time) []byte {
+	return p.appendEchoRequest(nil, seq, now)
+}
+
+// appendEchoRequest returns the echo request with sequence number seq, sent
+// at now, built in b, or in a new buffer if b is too small.
+func (p *Pinger) appendEchoRequest(b []byte, seq int, now time.Time) []byte {
+	typ := icmpv4EchoRequest
+	if !p.ipv4 {
+		typ = icmpv6EchoRequest
+	}
+	size := p.size(seq)
+	if size < 0 {
+		size = 0
+	}
+	if n := 8 + size; cap(b) >= n {
+		b = b[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	id, xseq := p.ident(), seq&0xffff
+	b[0], b[1], b[2], b[3] = byte(typ), 0, 0, 0
+	b[4], b[5] = byte(id>>8), byte(id)
+	b[6], b[7] = byte(xseq>>8), byte(xseq)
+	p.putData(b[8:], now)
+	if p.ipv4 {
+		// the kernel computes ICMPv6 checksums itself
+		s := checksum(b)
+		b[2], b[3] = byte(s>>8), byte(s)
+	}
+	return b
+}
+
+// recv reads from c until an echo reply addressed to this pinger arrives,
+// or an error message about one of its requests. The returned packet carries
+// the 16-bit sequence number of the reply, src the address it came from.
+func (p *Pinger) recv(c icmpConn, rb, oob []byte) (packet Packet, src *net.IPAddr, err error) {
+	for {
+		var n, oobn int
+		if n, oobn, src, err = readMsg(c, rb, oob); err != nil {
 			return
 		}
-		switch m.Type {
-		case icmpv4EchoRequest, icmpv6EchoRequest:
+		var b []byte
+		if p.hasIPHeader() {
+			// both come before any options, at fixed offsets
+			packet.TTL = int(rb[8])
+			packet.TOS = int(rb[1])
+			packet.Route = parseRoute(rb[:n])
+			packet.Timestamps = parseTimestamps(rb[:n])
+			b = ipv4Payload(rb[:n])
+		} else {
+			packet.TTL = parseTTL(oob[:oobn])
+			packet.TOS = parseTOS(oob[:oobn])
+			b = rb[:n]
+		}
+		m, perr := parseICMPMessage(b)
+		if perr != nil {
+			p.handleError(-1, &kindError{kind: ErrParse, err: perr})
+			continue
+		}
+		echo := p.match(m, src)
+		if echo == nil {
+			// the socket sees every ICMP message from the target,
+			// including our own requests on loopback and replies to
+			// other pingers
 			continue
 		}
-		packet.Rtt = time.Since(start)
-		break
+		// a message that filled the buffer may have been cut short, and
+		// then its checksum can't be checked
+		truncated := n == len(rb)
+		if p.ipv4 && !truncated && checksum(b) != 0 {
+			// the kernel checks ICMPv6 checksums itself, but raw
+			// sockets get ICMP messages unchecked
+			p.statsMu.Lock()
+			p.PacketsCorrupted++
+			p.statsMu.Unlock()
+			continue
+		}
+		packet.IPAddr, packet.Addr = p.raddr, p.addr
+		packet.Src = src
+		if p.ResolveNames && src != nil {
+			packet.SrcName = p.name(src.IP)
+		}
+		packet.Nbytes = len(b)
+		packet.Seq = echo.Seq
+		packet.Size = p.size(echo.Seq)
+		packet.ICMPType, packet.ICMPCode = m.Type, m.Code
+		packet.Type = replyType(p.ipv4, m.Type)
+		if _, ok := m.Body.(*icmpError); ok {
+			packet.Err = newICMPError(p.ipv4, m.Type, m.Code)
+		} else {
+			if len(echo.Data) >= timestampLen {
+				packet.SentAt = time.Unix(0, int64(binary.BigEndian.Uint64(echo.Data)))
+			}
+			packet.payload = echo.Data
+			packet.PatternMismatch = !p.patternMatches(echo.Data)
+			packet.Truncated = len(echo.Data) < packet.Size || truncated
+		}
+		return
+	}
+}
+
+// name returns the cached name of ip, starting a lookup if there is none
+// yet.
+func (p *Pinger) name(ip net.IP) string {
+	addr := ip.String()
+	p.namesMu.Lock()
+	defer p.namesMu.Unlock()
+	if name, ok := p.names[addr]; ok {
+		return name
+	}
+	if p.names == nil {
+		p.names = make(map[string]string)
+	}
+	p.names[addr] = ""
+	lookup := p.lookupAddr
+	if lookup == nil {
+		lookup = net.LookupAddr
+	}
+	go func() {
+		names, err := lookup(addr)
+		if err != nil || len(names) == 0 {
+			return
+		}
+		p.namesMu.Lock()
+		p.names[addr] = strings.TrimSuffix(names[0], ".")
+		p.namesMu.Unlock()
+	}()
+	return ""
+}
+
+// ident returns the echo identifier of p.
+func (p *Pinger) ident() int {
+	if p.Identifier != 0 {
+		return p.Identifier
+	}
+	return p.id
+}
+
+// match returns the echo request m answers, either as an echo reply or as
+// an error message quoting it, or nil if m isn't meant for this pinger.
+func (p *Pinger) match(m *icmpMessage, src *net.IPAddr) *icmpEcho {
+	var echo *icmpEcho
+	switch body := m.Body.(type) {
+	case *icmpEcho:
+		if m.Type == icmpv4EchoReply || m.Type == icmpv6EchoReply {
+			echo = body
+		}
+		// raw sockets see the replies of every host; those to a pinger
+		// of another target with the same identifier come from there.
+		// Errors come from anywhere on the way
+		if p.Privileged && !p.from(src) {
+			return nil
+		}
+	case *icmpError:
+		echo = body.echo()
+	}
+	// unprivileged sockets have their identifier rewritten by the kernel,
+	// which in turn only delivers replies carrying it
+	if echo == nil || p.Privileged && echo.ID != p.ident() {
+		return nil
+	}
+	return echo
+}
+
+// from reports whether src may be the target, which it is taken to be if
+// either is unknown.
+func (p *Pinger) from(src *net.IPAddr) bool {
+	if src == nil || p.raddr == nil || p.raddr.IP == nil || p.raddr.IP.IsUnspecified() {
+		return true
+	}
+	return src.IP.Equal(p.raddr.IP)
+}
+
+// Validate reports whether Run could start, without sending anything: that
+// the target resolved, to an address of the family of the local address,
+// that the options are valid and that the socket can be opened with them,
+// which for a privileged pinger takes root or CAP_NET_RAW. The socket is
+// closed again right away.
+func (p *Pinger) Validate() error {
+	if p.raddr.IP == nil {
+		// NewPinger leaves a target it couldn't resolve empty
+		if _, err := resolve(p.laddr.IP, p.addr); err != nil {
+			return err
+		}
+		return fmt.Errorf("unresolved target %q", p.addr)
+	}
+	if p.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout %v", p.Timeout)
+	}
+	if p.Flood && !p.Privileged {
+		return errFloodUnprivileged
+	}
+	c, err := p.open()
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// listen opens the socket shared by all pings of Run.
+func (p *Pinger) listen() error {
+	c, err := p.open()
+	if err != nil {
+		return err
+	}
+	p.conn = c
+	return nil
+}
+
+// icmpConn is what Run and Ping need of a socket, so that tests can
+// replace it.
+type icmpConn interface {
+	Write(b []byte) (int, error)
+	Read(b []byte) (int, error)
+	SetDeadline(t time.Time) error
+	Close() error
+}
+
+// open opens a socket for Run or Ping, with dialer if set.
+func (p *Pinger) open() (icmpConn, error) {
+	if p.dialer != nil {
+		return p.dialer()
+	}
+	return p.dial()
+}
+
+// dial opens the socket used to exchange ICMP messages with the target: a
+// raw socket when privileged, an ICMP datagram socket otherwise.
+func (p *Pinger) dial() (c net.Conn, err error) {
+	if p.TOS < 0 || p.TOS > 255 {
+		return nil, errTOS
+	}
+	if p.Identifier < 0 || p.Identifier > 0xffff {
+		return nil, errIdentifier
+	}
+	if p.Privileged {
+		c, err = dialRaw(p.ipv4, p.laddr, p.raddr)
+		err = noPrivilege(err)
+	} else {
+		c, err = dialDgram(p.ipv4, p.laddr, p.raddr, p.Identifier)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Interface != "" {
+		if err = bindToDevice(c.(syscall.Conn), p.Interface); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	opts, err := p.ipOptions()
+	if err == nil && opts != nil {
+		err = setIPOptions(c.(syscall.Conn), opts)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if p.DontFragment {
+		if err = setDontFragment(c.(syscall.Conn), p.ipv4); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if p.RecvBufferSize > 0 {
+		if err = c.(interface{ SetReadBuffer(int) error }).SetReadBuffer(p.RecvBufferSize); err != nil {
+			c.Close()
+			return nil, err
+		}
 	}
+	if p.TTL > 0 {
+		if err = p.setTTL(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if p.TOS > 0 {
+		if err = p.setTOS(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if !p.hasIPHeader() {
+		// the kernel strips the IP header, so the TTL and TOS have to be
+		// requested as control messages
+		if err = enableTTL(c.(syscall.Conn), p.ipv4); err == nil {
+			err = enableTOS(c.(syscall.Conn), p.ipv4)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if p.ControlConn != nil {
+		if err = p.control(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// control calls ControlConn with c.
+func (p *Pinger) control(c net.Conn) error {
+	rc, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var network string
+	switch {
+	case p.Privileged && p.ipv4:
+		network = "ip4:icmp"
+	case p.Privileged:
+		network = "ip6:ipv6-icmp"
+	case p.ipv4:
+		network = "udp4"
+	default:
+		network = "udp6"
+	}
+	return p.ControlConn(network, p.raddr.String(), rc)
+}
+
+// setTTL sets the TTL, or hop limit for IPv6, of packets sent on c.
+func (p *Pinger) setTTL(c net.Conn) error {
+	if p.ipv4 {
+		return ipv4.NewConn(c).SetTTL(p.TTL)
+	}
+	return ipv6.NewConn(c).SetHopLimit(p.TTL)
+}
+
+var (
+	errTOS        = errors.New("TOS must be between 0 and 255")
+	errIdentifier = errors.New("identifier must be between 0 and 65535")
+	errRunning    = errors.New("pinger is already running")
+
+	errFloodUnprivileged = errors.New("flood mode requires a privileged pinger")
+)
 
+// setTOS sets the type of service, or traffic class for IPv6, of packets
+// sent on c.
+func (p *Pinger) setTOS(c net.Conn) error {
+	if p.ipv4 {
+		return ipv4.NewConn(c).SetTOS(p.TOS)
+	}
+	return ipv6.NewConn(c).SetTrafficClass(p.TOS)
+}
+
+// hasIPHeader reports whether packets read from the socket start with an IP
+// header. That is the case for raw IPv4 sockets except on windows, and for
+// IPv4 datagram sockets on darwin.
+func (p *Pinger) hasIPHeader() bool {
+	return p.ipv4 && (p.Privileged && rawIPHeader || runtime.GOOS == "darwin")
+}
+
+// readMsg reads a packet from c into b along with its control messages and
+// source address. Sockets that only support ReadFrom, such as the raw
+// sockets of windows, report no control messages, and those that only
+// support Read no source address either.
+func readMsg(c icmpConn, b, oob []byte) (n, oobn int, src *net.IPAddr, err error) {
+	switch c := c.(type) {
+	case *rawConn:
+		return c.readMsg(b, oob)
+	case *net.IPConn:
+		n, oobn, _, src, err = c.ReadMsgIP(b, oob)
+	case *net.UDPConn:
+		var addr *net.UDPAddr
+		n, oobn, _, addr, err = c.ReadMsgUDP(b, oob)
+		if addr != nil {
+			src = &net.IPAddr{IP: addr.IP, Zone: addr.Zone}
+		}
+	case interface {
+		ReadFrom(b []byte) (int, net.Addr, error)
+	}:
+		var addr net.Addr
+		n, addr, err = c.ReadFrom(b)
+		src = ipAddr(addr)
+	default:
+		n, err = c.Read(b)
+	}
 	return
 }
 
+// ipAddr returns the IP address of addr, or nil if it has none.
+func ipAddr(addr net.Addr) *net.IPAddr {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr
+	case *net.UDPAddr:
+		return &net.IPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+	return nil
+}
+
 func ipv4Payload(b []byte) []byte {
 	if len(b) < 20 {
 		return b
@@ -224,11 +1922,24 @@ func ipv4Payload(b []byte) []byte {
 	return b[hdrlen:]
 }
 
-var finishOnce sync.Once
+// Stop makes a running Run stop sending and return, calling Finish as it
+// does when it completes. A Pinger that is stopped before Run is called
+// sends nothing. Stop may be called from any goroutine, more than once.
+func (p *Pinger) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
 
 func (p *Pinger) Finish() {
-	finishOnce.Do(func() {
+	p.finishOnce.Do(func() {
 		p.finished = true
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		if p.packets != nil {
+			close(p.packets)
+		}
 		handler := p.OnFinish
 		if handler != nil {
 			s := p.Statistics()
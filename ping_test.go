@@ -5,3 +5,1953 @@
 // taken from http://golang.org/src/pkg/net/ipraw_test.go
 
 package ping
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFinishPerPinger(t *testing.T) {
+	var finished [2]bool
+	for i := range finished {
+		i := i
+		p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+		p.OnFinish = func(*Statistics) {
+			finished[i] = true
+		}
+		p.Finish()
+		p.Finish()
+	}
+	if !finished[0] || !finished[1] {
+		t.Errorf("OnFinish called = %v, want both", finished)
+	}
+}
+
+func TestStatisticsBeforeRun(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	if loss := p.Statistics().PacketLoss; loss != 0 {
+		t.Errorf("PacketLoss = %v, want 0", loss)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = true
+	target, router := p.raddr, &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	tests := []struct {
+		name string
+		m    *icmpMessage
+		src  *net.IPAddr
+		want bool
+	}{
+		{"reply", &icmpMessage{Type: icmpv4EchoReply, Body: &icmpEcho{ID: p.id, Seq: 1}}, target, true},
+		{"reply from elsewhere", &icmpMessage{Type: icmpv4EchoReply, Body: &icmpEcho{ID: p.id, Seq: 1}}, router, false},
+		{"reply from unknown", &icmpMessage{Type: icmpv4EchoReply, Body: &icmpEcho{ID: p.id, Seq: 1}}, nil, true},
+		{"request", &icmpMessage{Type: icmpv4EchoRequest, Body: &icmpEcho{ID: p.id, Seq: 1}}, target, false},
+		{"other id", &icmpMessage{Type: icmpv4EchoReply, Body: &icmpEcho{ID: p.id ^ 1, Seq: 1}}, target, false},
+		{"time exceeded", &icmpMessage{Type: icmpv4TimeExceeded, Body: &icmpError{Data: quote(t, p.id)}}, router, true},
+		{"time exceeded other id", &icmpMessage{Type: icmpv4TimeExceeded, Body: &icmpError{Data: quote(t, p.id^1)}}, router, false},
+	}
+	for _, tt := range tests {
+		if got := p.match(tt.m, tt.src) != nil; got != tt.want {
+			t.Errorf("%s: match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	var rtts []time.Duration
+	for i := 100; i > 0; i-- {
+		rtts = append(rtts, time.Duration(i)*time.Millisecond)
+	}
+	var s Statistics
+	s.setPercentiles(rtts)
+	got := []time.Duration{s.P50Rtt, s.P90Rtt, s.P95Rtt, s.P99Rtt}
+	want := []time.Duration{50 * time.Millisecond, 90 * time.Millisecond, 95 * time.Millisecond, 99 * time.Millisecond}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("percentiles = %v, want %v", got, want)
+			break
+		}
+	}
+	if rtts[0] != 100*time.Millisecond {
+		t.Error("setPercentiles reordered its input")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	for _, rtt := range []time.Duration{10, 20, 15, 15, 25} {
+		p.updateStatistics(&Packet{Rtt: rtt * time.Millisecond})
+	}
+	// |20-10| + |15-20| + |15-15| + |25-15| = 25 over 4 differences
+	if got, want := p.Statistics().Jitter, 6250*time.Microsecond; got != want {
+		t.Errorf("Jitter = %v, want %v", got, want)
+	}
+}
+
+func TestTTLStatistics(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	// 0 is a reply without a TTL, which doesn't count
+	for _, ttl := range []int{57, 0, 55, 58, 56} {
+		p.updateStatistics(&Packet{Rtt: time.Millisecond, TTL: ttl})
+	}
+	if s := p.Statistics(); s.MinTTL != 55 || s.MaxTTL != 58 || s.LastTTL != 56 {
+		t.Errorf("MinTTL, MaxTTL, LastTTL = %d, %d, %d, want 55, 58, 56", s.MinTTL, s.MaxTTL, s.LastTTL)
+	}
+}
+
+func TestWarmupCount(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.WarmupCount = 2
+	p.PacketsSent = 5
+	for _, rtt := range []time.Duration{100, 50, 10, 20, 30} {
+		p.updateStatistics(&Packet{Rtt: rtt * time.Millisecond})
+	}
+	s := p.Statistics()
+	if s.PacketsRecv != 5 || s.PacketLoss != 0 || len(s.Rtts) != 3 || s.RttCount != 3 {
+		t.Errorf("received %d, loss %v%%, %d rtts, RttCount %d, want 5, 0%%, 3, 3", s.PacketsRecv, s.PacketLoss, len(s.Rtts), s.RttCount)
+	}
+	if s.AvgRtt != 20*time.Millisecond || s.MinRtt != 10*time.Millisecond || s.MaxRtt != 30*time.Millisecond || s.StdDevRtt != 10*time.Millisecond {
+		t.Errorf("min/avg/max/stddev = %v/%v/%v/%v, want 10ms/20ms/30ms/10ms", s.MinRtt, s.AvgRtt, s.MaxRtt, s.StdDevRtt)
+	}
+}
+
+func TestStatisticsCopiesRtts(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.updateStatistics(&Packet{Rtt: time.Millisecond})
+	s := p.Statistics()
+	s.Rtts[0] = 0
+	if p.rtts[0] != time.Millisecond {
+		t.Error("Statistics returned the pinger's own Rtts slice")
+	}
+}
+
+func TestStop(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, -1)
+	p.Interval = 10 * time.Millisecond
+	time.AfterFunc(50*time.Millisecond, p.Stop)
+	done := make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+	if p.PacketsSent == 0 {
+		t.Error("no packets sent before Stop")
+	}
+
+	p = NewPinger("0.0.0.0", "127.0.0.1", time.Second, -1)
+	p.Stop()
+	p.Run()
+	if p.PacketsSent != 0 {
+		t.Errorf("PacketsSent = %d after Stop before Run, want 0", p.PacketsSent)
+	}
+}
+
+func TestNewPingerE(t *testing.T) {
+	tests := []struct {
+		localIP, remote string
+		timeout         time.Duration
+		wantErr         bool
+	}{
+		{"0.0.0.0", "127.0.0.1", time.Second, false},
+		{"", "::1", time.Second, false},
+		{"0.0.0.0", "::1", time.Second, false},
+		{"127.0.0.1", "127.0.0.1", time.Second, false},
+		{"garbage", "127.0.0.1", time.Second, true},
+		{"0.0.0.0", "no such host.invalid", time.Second, true},
+		{"0.0.0.0", "127.0.0.1", 0, true},
+		{"::1", "127.0.0.1", time.Second, true},
+	}
+	for _, tt := range tests {
+		_, err := NewPingerE(tt.localIP, tt.remote, tt.timeout, 1)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewPingerE(%q, %q, %v) error = %v, wantErr %v", tt.localIP, tt.remote, tt.timeout, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPayloadTimestamp(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	now := time.Unix(1650000000, 123456789)
+	b := p.data(now, p.Size)
+	if len(b) != defaultSize {
+		t.Fatalf("len(data) = %d, want %d", len(b), defaultSize)
+	}
+	if got := time.Unix(0, int64(binary.BigEndian.Uint64(b))); !got.Equal(now) {
+		t.Errorf("embedded send time = %v, want %v", got, now)
+	}
+	if got := sentTime(now.Add(time.Second), now, now); !got.Equal(now) {
+		t.Errorf("sentTime accepted a send time in the future: %v", got)
+	}
+}
+
+func TestPackets(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 3)
+	p.Interval = 10 * time.Millisecond
+	packets := p.Packets()
+	go p.Run()
+	var n int
+	for pkt := range packets {
+		if pkt.Lost {
+			t.Errorf("packet %d lost", pkt.Seq)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("got %d packets, want 3", n)
+	}
+}
+
+func TestNew(t *testing.T) {
+	p, err := New("127.0.0.1", WithInterval(time.Millisecond), WithCount(3), WithSize(100), WithSource("127.0.0.1"), WithPrivileged(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Interval != time.Millisecond || p.Count != 3 || p.Size != 100 || p.Privileged || p.Timeout != defaultTimeout {
+		t.Errorf("options not applied: %+v", p)
+	}
+	if _, err := New("127.0.0.1", WithSource("garbage")); err == nil {
+		t.Error("New accepted an invalid source address")
+	}
+}
+
+// quote returns an IPv4 datagram carrying an echo request with identifier id,
+// as quoted by ICMP error messages.
+func quote(t *testing.T, id int) []byte {
+	b, err := (&icmpMessage{Type: icmpv4EchoRequest, Body: &icmpEcho{ID: id, Seq: 1}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := make([]byte, 20)
+	hdr[0], hdr[9] = 0x45, 1
+	return append(hdr, b...)
+}
+
+func TestErrorFromRouter(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	// a router on the way, which a socket connected to the target would
+	// never hear from
+	router := &net.IPAddr{IP: net.IPv4(127, 0, 0, 5)}
+	r, err := net.ListenIP("ip4:icmp", router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	msg, err := (&icmpMessage{Type: icmpv4TimeExceeded, Body: &icmpError{Data: quote(t, p.id)}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.dialer = func() (icmpConn, error) {
+		c, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+		// queue the error ahead of the reply to the request it quotes
+		if _, err := r.WriteTo(msg, p.raddr); err != nil {
+			c.Close()
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+		return c, nil
+	}
+	packet, err := p.Ping(1)
+	if packet.Type != TimeExceeded || packet.Src == nil || !packet.Src.IP.Equal(router.IP) {
+		t.Errorf("Ping(1) = %v from %v, %v, want time exceeded from %v", packet.Type, packet.Src, err, router.IP)
+	}
+}
+
+func TestTraceroute(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	for _, target := range []string{"127.0.0.1", "::1"} {
+		p := NewPinger("", target, time.Second, 1)
+		hops, err := p.Traceroute(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hops) != 1 || hops[0].Timeout || !hops[0].Addr.IP.Equal(p.IPAddr().IP) {
+			t.Errorf("Traceroute(%s) = %+v, want a single hop to the target", target, hops)
+		}
+	}
+}
+
+func TestStatisticsJSON(t *testing.T) {
+	b, err := json.Marshal(Statistics{PacketsSent: 2, PacketsRecv: 1, PacketLoss: 50, Rtts: []time.Duration{1500 * time.Microsecond}, AvgRtt: 1500 * time.Microsecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["packets_sent"] != 2.0 || got["packet_loss"] != 50.0 || got["avg_rtt_ms"] != 1.5 {
+		t.Errorf("unexpected JSON %s", b)
+	}
+}
+
+func TestStatisticsString(t *testing.T) {
+	s := Statistics{
+		PacketsSent: 4, PacketsRecv: 4,
+		MinRtt: 100 * time.Microsecond, AvgRtt: 200 * time.Microsecond,
+		MaxRtt: 300 * time.Microsecond, StdDevRtt: 50 * time.Microsecond,
+		Duration: 3004 * time.Millisecond,
+	}
+	want := "4 packets transmitted, 4 received, 0% packet loss, time 3004ms\nrtt min/avg/max/mdev = 0.100/0.200/0.300/0.050 ms"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	s = Statistics{PacketsSent: 2, PacketLoss: 100}
+	want = "2 packets transmitted, 0 received, 100% packet loss, time 0ms"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	ip := &net.IPAddr{IP: net.IPv4(1, 1, 1, 1)}
+	for _, tt := range []struct {
+		packet Packet
+		want   string
+	}{
+		{Packet{IPAddr: ip, Nbytes: 64, Seq: 3, TTL: 59, Rtt: 12345 * time.Microsecond},
+			"64 bytes from 1.1.1.1: icmp_seq=3 ttl=59 time=12.345 ms"},
+		{Packet{IPAddr: ip, Nbytes: 64, Seq: 1, TTL: 64, Rtt: 45 * time.Microsecond, Duplicate: true},
+			"64 bytes from 1.1.1.1: icmp_seq=1 ttl=64 time=0.045 ms (DUP!)"},
+		{Packet{IPAddr: ip, Nbytes: 64, Seq: 6, TTL: 59, Rtt: 123456 * time.Microsecond},
+			"64 bytes from 1.1.1.1: icmp_seq=6 ttl=59 time=123.456 ms"},
+		{Packet{IPAddr: ip, Seq: 2, Lost: true},
+			"Request timeout for icmp_seq 2"},
+		{Packet{IPAddr: ip, Src: ip, SrcName: "one.one.one.one", Nbytes: 64, Seq: 3, TTL: 59, Rtt: 12345 * time.Microsecond},
+			"64 bytes from one.one.one.one (1.1.1.1): icmp_seq=3 ttl=59 time=12.345 ms"},
+		{Packet{IPAddr: ip, Nbytes: 64, Seq: 4, TTL: 59, Rtt: 2 * time.Millisecond, Route: []net.IP{net.IPv4(10, 0, 0, 1), ip.IP}},
+			"64 bytes from 1.1.1.1: icmp_seq=4 ttl=59 time=2.000 ms\nRR: \t10.0.0.1\n    \t1.1.1.1"},
+		{Packet{IPAddr: ip, Nbytes: 64, Seq: 5, TTL: 59, Rtt: 2 * time.Millisecond, Timestamps: []time.Duration{1000 * time.Millisecond, 1002 * time.Millisecond}},
+			"64 bytes from 1.1.1.1: icmp_seq=5 ttl=59 time=2.000 ms\nTS: \t1000 absolute\n    \t2"},
+	} {
+		if got := tt.packet.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+type lineLogger []string
+
+func (l *lineLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	var lines lineLogger
+	p, err := New("127.0.0.1", WithCount(2), WithInterval(10*time.Millisecond), WithLogger(&lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Verbose = true
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], " bytes from 127.0.0.1: icmp_seq=0 ") {
+		t.Errorf("unexpected verbose output %q", lines)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to an interface is only supported on Linux")
+	}
+	p, err := New("127.0.0.1", WithInterface("lo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Ping(0); err != nil {
+		t.Errorf("Ping on lo: %v", err)
+	}
+	p.Interface = "nosuchif0"
+	if _, err := p.Ping(0); err == nil {
+		t.Error("Ping succeeded on a nonexistent interface")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	g := NewGroup()
+	g.Interval = 10 * time.Millisecond
+	targets := []string{"127.0.0.1", "::1"}
+	for _, target := range targets {
+		if err := g.Add(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 55*time.Millisecond)
+	defer cancel()
+	if err := g.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		s := g.Statistics(target)
+		if s.PacketsSent == 0 || s.PacketsRecv == 0 || s.PacketsRecv > s.PacketsSent {
+			t.Errorf("%s: sent %d, received %d", target, s.PacketsSent, s.PacketsRecv)
+		}
+	}
+	if g.Statistics("192.0.2.1") != nil {
+		t.Error("Statistics returned a result for a target never added")
+	}
+}
+
+func TestGroupAddAll(t *testing.T) {
+	g := NewGroup()
+	g.lookupIP = func(host string) ([]net.IP, error) {
+		if host != "example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1"), net.IPv4(127, 0, 0, 1)}, nil
+	}
+	addrs, err := g.AddAll("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1", "::1"}; strings.Join(addrs, " ") != strings.Join(want, " ") {
+		t.Errorf("AddAll = %v, want %v", addrs, want)
+	}
+	for _, addr := range addrs {
+		if g.Statistics(addr) == nil {
+			t.Errorf("%s was not added", addr)
+		}
+	}
+	if _, err := g.AddAll("nosuchhost.invalid"); err == nil {
+		t.Error("AddAll succeeded for a host that doesn't resolve")
+	}
+}
+
+func TestFlood(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 50)
+	p.Flood = true
+	start := time.Now()
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// at a 1s Interval 50 packets would take close to a minute
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("flooding 50 packets took %v", d)
+	}
+	if p.PacketsRecv != 50 {
+		t.Errorf("PacketsRecv = %d, want 50", p.PacketsRecv)
+	}
+
+	p = NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Flood, p.Privileged = true, false
+	if err := p.RunContext(context.Background()); err == nil {
+		t.Error("unprivileged flood ping succeeded")
+	}
+}
+
+func TestMaxStored(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.MaxStored = 3
+	for i := 1; i <= 5; i++ {
+		p.updateStatistics(&Packet{Rtt: time.Duration(i) * time.Millisecond})
+	}
+	s := p.Statistics()
+	want := []time.Duration{3 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond}
+	if len(s.Rtts) != len(want) || s.Rtts[0] != want[0] || s.Rtts[1] != want[1] || s.Rtts[2] != want[2] {
+		t.Errorf("Rtts = %v, want %v", s.Rtts, want)
+	}
+	if s.MinRtt != time.Millisecond || s.AvgRtt != 3*time.Millisecond || s.RttCount != 5 {
+		t.Errorf("MinRtt, AvgRtt, RttCount = %v, %v, %d, want them over all packets", s.MinRtt, s.AvgRtt, s.RttCount)
+	}
+}
+
+func TestStdDev(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	// mean 5ms, squared differences sum to 32ms²
+	for _, rtt := range []time.Duration{2, 4, 4, 4, 5, 5, 7, 9} {
+		p.updateStatistics(&Packet{Rtt: rtt * time.Millisecond})
+	}
+	s := p.Statistics()
+	if s.AvgRtt != 5*time.Millisecond {
+		t.Errorf("AvgRtt = %v, want 5ms", s.AvgRtt)
+	}
+	if s.PopStdDevRtt != 2*time.Millisecond {
+		t.Errorf("PopStdDevRtt = %v, want 2ms", s.PopStdDevRtt)
+	}
+	// sqrt(32/7) ms
+	if want := 2138090 * time.Nanosecond; s.StdDevRtt != want {
+		t.Errorf("StdDevRtt = %v, want %v", s.StdDevRtt, want)
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	var rtts []time.Duration
+	for _, rtt := range []time.Duration{2, 4, 4, 4, 5, 5, 7, 9} {
+		rtts = append(rtts, rtt*time.Millisecond)
+	}
+	s := ComputeStats(rtts)
+	if s.PacketsSent != 8 || s.PacketsRecv != 8 || s.PacketLoss != 0 {
+		t.Errorf("sent/recv/loss = %d/%d/%g, want 8/8/0", s.PacketsSent, s.PacketsRecv, s.PacketLoss)
+	}
+	got := []time.Duration{s.MinRtt, s.MaxRtt, s.AvgRtt, s.PopStdDevRtt, s.StdDevRtt, s.P50Rtt, s.P99Rtt}
+	want := []time.Duration{2 * time.Millisecond, 9 * time.Millisecond, 5 * time.Millisecond, 2 * time.Millisecond,
+		2138090 * time.Nanosecond, 4 * time.Millisecond, 9 * time.Millisecond}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("min, max, avg, pop stddev, stddev, p50, p99 = %v, want %v", got, want)
+			break
+		}
+	}
+	// differences 2, 0, 0, 1, 0, 2, 2 over 7, give or take the rounding of
+	// the running mean
+	if s.Jitter.Round(time.Microsecond) != time.Millisecond {
+		t.Errorf("Jitter = %v, want 1ms", s.Jitter)
+	}
+	rtts[0] = 0
+	if s.Rtts[0] != 2*time.Millisecond {
+		t.Error("Rtts shares its backing array with the argument")
+	}
+
+	if s := ComputeStats(nil); s.PacketsRecv != 0 || s.AvgRtt != 0 || s.StdDevRtt != 0 || s.P50Rtt != 0 {
+		t.Errorf("ComputeStats(nil) = %+v, want zero statistics", s)
+	}
+}
+
+func TestNoTrailingInterval(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 2)
+	p.Interval = 200 * time.Millisecond
+	start := time.Now()
+	p.Run()
+	// one interval between the two requests, none after the last reply
+	if d := time.Since(start); d >= 2*p.Interval {
+		t.Errorf("Run took %v, want it to end right after the last reply", d)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p, err := New("127.0.0.1", WithInterval(10*time.Millisecond), WithDeadline(55*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Run took %v past a 55ms deadline", d)
+	}
+	if p.PacketsSent < 3 || p.PacketsSent > 7 {
+		t.Errorf("PacketsSent = %d, want about 6", p.PacketsSent)
+	}
+}
+
+func TestDiscoverMTU(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("setting the don't fragment bit is only supported on Linux")
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	// loopback carries the largest IP packets there are
+	mtu, err := p.DiscoverMTU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != maxMTU {
+		t.Errorf("DiscoverMTU() = %d, want %d", mtu, maxMTU)
+	}
+	if p.Size != defaultSize || p.DontFragment {
+		t.Error("DiscoverMTU left Size or DontFragment changed")
+	}
+}
+
+func TestTOS(t *testing.T) {
+	if _, err := New("127.0.0.1", WithTOS(256)); err == nil {
+		t.Error("New accepted a TOS of 256")
+	}
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	for _, target := range []string{"127.0.0.1", "::1"} {
+		p, err := New(target, WithTOS(0xb8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := p.Ping(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// loopback echoes the TOS of the request
+		if runtime.GOOS == "linux" && packet.TOS != 0xb8 {
+			t.Errorf("%s: reply TOS = %#x, want 0xb8", target, packet.TOS)
+		}
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	var reordered []int
+	p.OnReorder = func(pkt *Packet) {
+		reordered = append(reordered, pkt.Seq)
+	}
+	for _, seq := range []int{0, 2, 1, 3} {
+		p.handleRecv(&Packet{Seq: seq})
+	}
+	if s := p.Statistics(); s.PacketsOutOfOrder != 1 || len(reordered) != 1 || reordered[0] != 1 {
+		t.Errorf("PacketsOutOfOrder = %d, OnReorder called for %v, want seq 1 only", s.PacketsOutOfOrder, reordered)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, size := range []int{56, 57} {
+		b, err := (&icmpMessage{Type: icmpv4EchoReply, Body: &icmpEcho{ID: 1, Seq: 2, Data: make([]byte, size)}}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum(b) != 0 {
+			t.Errorf("size %d: marshaled message has an invalid checksum", size)
+		}
+		b[len(b)-1] ^= 0x10
+		if checksum(b) == 0 {
+			t.Errorf("size %d: corrupted message has a valid checksum", size)
+		}
+	}
+}
+
+func TestSetPrivileged(t *testing.T) {
+	detected := HasPrivilege()
+	defer SetPrivileged(detected)
+	SetPrivileged(!detected)
+	if HasPrivilege() != !detected {
+		t.Error("SetPrivileged did not override HasPrivilege")
+	}
+	if p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1); p.Privileged != !detected {
+		t.Error("new Pinger ignores SetPrivileged")
+	}
+	if DetectPrivilege() != detected {
+		t.Error("DetectPrivilege did not detect again")
+	}
+
+	// pingers created in other goroutines read the result meanwhile, which
+	// go test -race checks
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+		}()
+	}
+	SetPrivileged(!detected)
+	DetectPrivilege()
+	wg.Wait()
+}
+
+func TestSetPrivilegeProbe(t *testing.T) {
+	detected := HasPrivilege()
+	defer func() {
+		SetPrivilegeProbe("", "")
+		DetectPrivilege()
+	}()
+	for _, tt := range [][2]string{{"", "nowhere"}, {"127.0.0.1", ""}, {"127.0.0.1", "::1"}} {
+		if err := SetPrivilegeProbe(tt[0], tt[1]); err == nil {
+			t.Errorf("SetPrivilegeProbe(%q, %q) succeeded", tt[0], tt[1])
+		}
+	}
+	if err := SetPrivilegeProbe("127.0.0.1", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if DetectPrivilege() != detected {
+		t.Errorf("DetectPrivilege() with a loopback probe != %v", detected)
+	}
+	if !HasPrivilege() {
+		return
+	}
+	// an address of no interface can't be bound to
+	if err := SetPrivilegeProbe("192.0.2.1", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if DetectPrivilege() || NonPrivMsg == "" {
+		t.Errorf("DetectPrivilege() from 192.0.2.1 = true, %q, want false with a reason", NonPrivMsg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p := NewPinger("0.0.0.0", "no such host.invalid", time.Second, 1)
+	if err := p.Validate(); err == nil {
+		t.Error("Validate succeeded for an unresolvable host")
+	}
+	p = NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged, p.Flood = false, true
+	if err := p.Validate(); !errors.Is(err, errFloodUnprivileged) {
+		t.Errorf("Validate() of an unprivileged flood = %v, want %v", err, errFloodUnprivileged)
+	}
+	p.Flood = false
+	var sent int
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte {
+			sent++
+			return nil
+		}), nil
+	}
+	if err := p.Validate(); err != nil || sent != 0 {
+		t.Errorf("Validate() = %v with %d requests sent, want nil and none", err, sent)
+	}
+	p.TOS = 256
+	p.dialer = nil
+	if err := p.Validate(); !errors.Is(err, errTOS) {
+		t.Errorf("Validate() with TOS 256 = %v, want %v", err, errTOS)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		kind error
+	}{
+		{classify(os.NewSyscallError("sendto", syscall.EHOSTUNREACH)), ErrUnreachable},
+		{classify(os.ErrDeadlineExceeded), ErrTimeout},
+		{newICMPError(true, icmpv4DestUnreachable, 1), ErrUnreachable},
+		{newICMPError(false, icmpv6DestUnreachable, 0), ErrUnreachable},
+	} {
+		if !errors.Is(tt.err, tt.kind) {
+			t.Errorf("%v is not %v", tt.err, tt.kind)
+		}
+	}
+	if err := newICMPError(true, icmpv4TimeExceeded, 0); errors.Is(err, ErrUnreachable) {
+		t.Errorf("%v is %v", err, ErrUnreachable)
+	}
+	if err := classify(syscall.ENOBUFS); err != syscall.ENOBUFS {
+		t.Errorf("classify(ENOBUFS) = %#v, want it unchanged", err)
+	}
+
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = false
+	var errs []error
+	p.OnError = func(seq int, err error) { errs = append(errs, err) }
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{{0}, echoReply(req)} }), nil
+	}
+	if _, err := p.Ping(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrParse) {
+		t.Errorf("OnError called with %v, want %v", errs, ErrParse)
+	}
+}
+
+func TestNoPrivilege(t *testing.T) {
+	err := noPrivilege(os.NewSyscallError("socket", syscall.EPERM))
+	if !errors.Is(err, ErrNoPrivilege) || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("noPrivilege(EPERM) = %v, want ErrNoPrivilege wrapping EPERM", err)
+	}
+	if !strings.Contains(err.Error(), "CAP_NET_RAW") {
+		t.Errorf("noPrivilege(EPERM) = %q, want a hint at CAP_NET_RAW", err)
+	}
+	if err := noPrivilege(syscall.ENOBUFS); errors.Is(err, ErrNoPrivilege) {
+		t.Errorf("noPrivilege(ENOBUFS) = %v, want it unchanged", err)
+	}
+}
+
+// fakeConn answers the echo requests written to it with replies made by
+// reply, without touching the network.
+type fakeConn struct {
+	reply    func(req *icmpEcho) [][]byte
+	replies  chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newFakeConn(reply func(req *icmpEcho) [][]byte) *fakeConn {
+	return &fakeConn{reply: reply, replies: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+// echoReply returns the marshaled reply to req, as a real host would send.
+func echoReply(req *icmpEcho) []byte {
+	b, _ := (&icmpMessage{Type: icmpv4EchoReply, Body: req}).Marshal()
+	return b
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	m, err := parseICMPMessage(b)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range c.reply(m.Body.(*icmpEcho)) {
+		c.replies <- r
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case r := <-c.replies:
+		return copy(b, r), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestFakeConn(t *testing.T) {
+	// seq 1 is lost, seq 2 is answered twice
+	reply := func(req *icmpEcho) [][]byte {
+		switch req.Seq {
+		case 1:
+			return nil
+		case 2:
+			return [][]byte{echoReply(req), echoReply(req)}
+		}
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", 50*time.Millisecond, 4)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := p.Statistics()
+	if s.PacketsSent != 4 || s.PacketsRecv != 3 || s.PacketsRecvDuplicates != 1 {
+		t.Errorf("sent %d, received %d, duplicates %d, want 4, 3, 1", s.PacketsSent, s.PacketsRecv, s.PacketsRecvDuplicates)
+	}
+
+	if _, err := p.Ping(0); err != nil {
+		t.Errorf("Ping(0): %v", err)
+	}
+	if _, err := p.Ping(1); !errors.Is(err, os.ErrDeadlineExceeded) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("Ping(1) error = %v, want a timeout", err)
+	}
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1650000000, 0)}
+	rtts := []time.Duration{200, 300, 250, 250, 400}
+	reply := func(req *icmpEcho) [][]byte {
+		clock.Advance(rtts[req.Seq] * time.Millisecond)
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, len(rtts))
+	// in adaptive mode each reply makes the next request due, as the
+	// clock only moves on writes
+	p.Privileged, p.Adaptive = false, true
+	p.now = clock.Now
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := p.Statistics()
+	got := []time.Duration{s.MinRtt, s.MaxRtt, s.AvgRtt, s.PopStdDevRtt, s.Jitter}
+	// squared differences from 280ms sum to 23000ms², |100|+|50|+|0|+|150|
+	// over 4
+	want := []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 280 * time.Millisecond,
+		time.Duration(math.Round(math.Sqrt(23000.0/5) * 1e6)), 75 * time.Millisecond}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("min, max, avg, stddev, jitter = %v, want %v", got, want)
+			break
+		}
+	}
+	// requests go out as the replies come in, the last one 400ms after
+	// the fifth request at 1s
+	if s.Duration != 1400*time.Millisecond || s.BytesSent != 5*64 || s.BytesRecv != 5*64 {
+		t.Errorf("Duration, BytesSent, BytesRecv = %v, %d, %d, want 1.4s, 320, 320", s.Duration, s.BytesSent, s.BytesRecv)
+	}
+}
+
+func TestClockStepBack(t *testing.T) {
+	clock := &tickingClock{now: time.Unix(1650000000, 0), step: time.Millisecond}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 3)
+	p.Privileged = false
+	p.Interval = 10 * time.Millisecond
+	p.now = clock.Now
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte {
+			if req.Seq == 1 {
+				// the clock is stepped back while the request is out
+				clock.mu.Lock()
+				clock.now = clock.now.Add(-time.Second)
+				clock.mu.Unlock()
+			}
+			return [][]byte{echoReply(req)}
+		}), nil
+	}
+	var stepped []int
+	p.OnRecv = func(pkt *Packet) {
+		if pkt.Rtt < 0 {
+			t.Errorf("packet %d: negative rtt %v", pkt.Seq, pkt.Rtt)
+		}
+		if pkt.ClockStepped {
+			stepped = append(stepped, pkt.Seq)
+		}
+	}
+	start := time.Now()
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("run took %v, the schedule waited out the step", d)
+	}
+	if len(stepped) != 1 || stepped[0] != 1 {
+		t.Errorf("clock stepped back for packets %v, want [1]", stepped)
+	}
+	s := p.Statistics()
+	if s.PacketsRecv != 3 || len(s.Rtts) != 2 {
+		t.Errorf("PacketsRecv, len(Rtts) = %d, %d, want 3, 2", s.PacketsRecv, len(s.Rtts))
+	}
+	if s.MinRtt <= 0 {
+		t.Errorf("MinRtt = %v, want positive", s.MinRtt)
+	}
+}
+
+func TestRawRecv(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 2)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.Pattern = []byte("cookie")
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte {
+			if req.Seq == 0 {
+				return [][]byte{echoReply(req), echoReply(req)}
+			}
+			return [][]byte{echoReply(req)}
+		}), nil
+	}
+	var seqs []int
+	p.OnRawRecv = func(seq int, data []byte) {
+		seqs = append(seqs, seq)
+		if len(data) != p.Size || string(data[timestampLen:timestampLen+6]) != "cookie" {
+			t.Errorf("seq %d: payload %q, want %d bytes of send time and pattern", seq, data, p.Size)
+		}
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(seqs), "[0 0 1]"; got != want {
+		t.Errorf("OnRawRecv called for %s, want %s", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	tests := []struct {
+		localIP, remoteIP string
+		timeout           time.Duration
+	}{
+		{"0.0.0.0", "127.0.0.1", time.Second},
+		{"127.0.0.1", "127.0.0.1", time.Second},
+		{"", "::1", time.Second},
+	}
+	for _, tt := range tests {
+		p := NewPinger(tt.localIP, tt.remoteIP, tt.timeout, 1)
+		var stats *Statistics
+		p.OnFinish = func(s *Statistics) {
+			stats = s
+		}
+		p.Run()
+		if stats == nil || stats.PacketsSent != 1 || stats.PacketsRecv != 1 {
+			t.Errorf("Run(%q, %q) statistics = %+v, want one reply", tt.localIP, tt.remoteIP, stats)
+		}
+	}
+}
+
+func TestReachable(t *testing.T) {
+	if _, err := Reachable("no such host.invalid", time.Second); err == nil {
+		t.Error("Reachable succeeded for an unresolvable host")
+	}
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	rtt, err := Reachable("127.0.0.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || rtt >= time.Second {
+		t.Errorf("Reachable(127.0.0.1) = %v", rtt)
+	}
+}
+
+func TestPacketSrc(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	for _, target := range []string{"127.0.0.1", "::1"} {
+		p := NewPinger("", target, time.Second, 1)
+		packet, err := p.Ping(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Src == nil || !packet.Src.IP.Equal(p.IPAddr().IP) {
+			t.Errorf("Ping(%s) reply from %v", target, packet.Src)
+		}
+	}
+}
+
+// fromConn is a fakeConn that reports the address replies come from, like
+// an unconnected socket.
+type fromConn struct {
+	*fakeConn
+	from net.Addr
+}
+
+func (c fromConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.from, err
+}
+
+func TestReadFrom(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = false
+	from := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	p.dialer = func() (icmpConn, error) {
+		return fromConn{newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), from}, nil
+	}
+	packet, err := p.Ping(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Src != from {
+		t.Errorf("Ping(0) reply from %v, want %v", packet.Src, from)
+	}
+}
+
+func TestPacketTimestamps(t *testing.T) {
+	start := time.Unix(1650000000, 0)
+	clock := &fakeClock{now: start}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = false
+	p.now = clock.Now
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte {
+			clock.Advance(15 * time.Millisecond)
+			return [][]byte{echoReply(req)}
+		}), nil
+	}
+	packet, err := p.Ping(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !packet.SentAt.Equal(start) || !packet.RecvAt.Equal(start.Add(15*time.Millisecond)) || packet.Rtt != 15*time.Millisecond {
+		t.Errorf("SentAt, RecvAt, Rtt = %v, %v, %v", packet.SentAt, packet.RecvAt, packet.Rtt)
+	}
+}
+
+func TestPattern(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = false
+	p.Pattern = []byte{0xff, 0x00, 0x5a}
+	p.Size = 14
+	b := p.data(time.Unix(1650000000, 0), p.Size)
+	if want := []byte{0xff, 0x00, 0x5a, 0xff, 0x00, 0x5a}; !bytes.Equal(b[timestampLen:], want) {
+		t.Fatalf("payload after the timestamp = %x, want %x", b[timestampLen:], want)
+	}
+	for _, corrupt := range []bool{false, true} {
+		corrupt := corrupt
+		p.dialer = func() (icmpConn, error) {
+			return newFakeConn(func(req *icmpEcho) [][]byte {
+				if corrupt {
+					req.Data[len(req.Data)-1] ^= 1
+				}
+				return [][]byte{echoReply(req)}
+			}), nil
+		}
+		packet, err := p.Ping(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.PatternMismatch != corrupt {
+			t.Errorf("corrupt %v: PatternMismatch = %v", corrupt, packet.PatternMismatch)
+		}
+	}
+}
+
+func TestPayloadSeed(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	var requests [][]byte
+	for _, seed := range []int64{42, 42, 43} {
+		p, err := New("127.0.0.1", WithIdentifier(0x1234), WithPayloadSeed(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, p.echoRequest(0, now))
+	}
+	if !bytes.Equal(requests[0], requests[1]) {
+		t.Errorf("requests with the same seed differ:\n%x\n%x", requests[0], requests[1])
+	}
+	if bytes.Equal(requests[0][8+timestampLen:], requests[2][8+timestampLen:]) {
+		t.Error("requests with different seeds carry the same payload")
+	}
+
+	p, _ := New("127.0.0.1", WithPayloadSeed(42), WithPrivileged(false))
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	if packet, err := p.Ping(0); err != nil || packet.PatternMismatch {
+		t.Errorf("Ping(0) with a seed = %v, PatternMismatch %v", err, packet.PatternMismatch)
+	}
+}
+
+// failingConn is a fakeConn whose writes of one sequence number fail.
+type failingConn struct {
+	*fakeConn
+	seq int
+}
+
+func (c failingConn) Write(b []byte) (int, error) {
+	if m, err := parseICMPMessage(b); err == nil && m.Body.(*icmpEcho).Seq == c.seq {
+		return 0, errors.New("write failed")
+	}
+	return c.fakeConn.Write(b)
+}
+
+func TestOnError(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", 20*time.Millisecond, 3)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) {
+		return failingConn{newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), 1}, nil
+	}
+	var errSeqs, lostSeqs []int
+	p.OnError = func(seq int, err error) { errSeqs = append(errSeqs, seq) }
+	p.OnLost = func(pkt *Packet) { lostSeqs = append(lostSeqs, pkt.Seq) }
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(errSeqs) != 1 || errSeqs[0] != 1 || len(lostSeqs) != 0 {
+		t.Errorf("OnError called for %v, OnLost for %v, want OnError for seq 1 only", errSeqs, lostSeqs)
+	}
+
+	p = NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.dialer = func() (icmpConn, error) { return nil, errors.New("no socket") }
+	errSeqs = nil
+	p.OnError = func(seq int, err error) { errSeqs = append(errSeqs, seq) }
+	if err := p.RunContext(context.Background()); err == nil || len(errSeqs) != 1 || errSeqs[0] != -1 {
+		t.Errorf("RunContext error = %v, OnError called for %v, want an error for seq -1", err, errSeqs)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.PacketsSent = 4
+	for _, rtt := range []time.Duration{10, 20, 30} {
+		p.updateStatistics(&Packet{Rtt: rtt * time.Millisecond})
+	}
+	snap, s := p.Snapshot(), p.Statistics()
+	if snap.PacketsSent != s.PacketsSent || snap.PacketsRecv != s.PacketsRecv || snap.PacketLoss != s.PacketLoss ||
+		snap.MinRtt != s.MinRtt || snap.MaxRtt != s.MaxRtt || snap.AvgRtt != s.AvgRtt ||
+		snap.StdDevRtt != s.StdDevRtt || snap.Jitter != s.Jitter {
+		t.Errorf("Snapshot() = %+v, disagrees with Statistics() = %+v", snap, s)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { p.Snapshot() }); allocs != 0 {
+		t.Errorf("Snapshot allocates %v times", allocs)
+	}
+}
+
+func TestSetTarget(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", 50*time.Millisecond, 2)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetTarget("127.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.IPAddr().String(); got != "127.0.0.2" {
+		t.Errorf("IPAddr() = %s, want 127.0.0.2", got)
+	}
+	if s := p.Statistics(); s.PacketsSent != 0 || s.PacketsRecv != 0 || len(s.Rtts) != 0 {
+		t.Errorf("statistics not reset: %+v", s)
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Statistics(); s.PacketsSent != 2 || s.PacketsRecv != 2 {
+		t.Errorf("sent %d, received %d after SetTarget, want 2, 2", s.PacketsSent, s.PacketsRecv)
+	}
+
+	if err := p.SetTarget("::1"); err != nil {
+		t.Errorf("SetTarget(::1): %v", err)
+	}
+	p = NewPinger("127.0.0.1", "127.0.0.1", time.Second, 1)
+	if err := p.SetTarget("::1"); err == nil {
+		t.Error("SetTarget(::1) from an IPv4 source: no error")
+	}
+}
+
+func TestReset(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", 50*time.Millisecond, 3)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Reset()
+	s := p.Statistics()
+	if s.PacketsSent != 0 || s.PacketsRecv != 0 || len(s.Rtts) != 0 || s.MinRtt != 0 || s.MaxRtt != 0 ||
+		s.AvgRtt != 0 || s.StdDevRtt != 0 || s.Duration != 0 || s.BytesSent != 0 {
+		t.Errorf("statistics not reset: %+v", s)
+	}
+
+	// the next request after Reset neither reuses a sequence number nor
+	// takes the old round-trip times into account
+	if seq := p.countSent(time.Now()); seq != 3 {
+		t.Errorf("sequence number after Reset = %d, want 3", seq)
+	}
+	p.handleRecv(&Packet{Seq: 3, Rtt: time.Hour})
+	s = p.Statistics()
+	if s.PacketsSent != 1 || s.PacketsRecv != 1 || s.MinRtt != time.Hour || s.AvgRtt != time.Hour {
+		t.Errorf("after Reset and one ping got %+v", s)
+	}
+}
+
+// tickingClock is a clock that moves on by step whenever it is read, like
+// a slow machine.
+type tickingClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+func TestIntervalDrift(t *testing.T) {
+	clock := &tickingClock{now: time.Unix(1650000000, 0), step: 3 * time.Millisecond}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 20)
+	p.Privileged = false
+	p.Interval = 10 * time.Millisecond
+	p.now = clock.Now
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 19 intervals and a few clock readings to receive the last reply;
+	// counting each interval from when the request went out instead adds
+	// the 1.5ms the clock is late on average to every one of them
+	if s := p.Statistics(); s.Duration >= 200*time.Millisecond {
+		t.Errorf("Duration = %v for 20 requests 10ms apart, want less than 200ms", s.Duration)
+	}
+}
+
+func TestIntervalJitter(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Interval = 10 * time.Millisecond
+	p.IntervalJitter = 5 * time.Millisecond
+	const n = 10000
+	var sum time.Duration
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < n; i++ {
+		d := p.nextInterval()
+		if d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("nextInterval() = %v, want within 10ms±5ms", d)
+		}
+		sum += d
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("nextInterval() always %v, want it jittered", sum/n)
+	}
+	// the mean of 10000 draws from ±5ms is well within 0.1ms of 0
+	if avg := sum / n; avg < 9900*time.Microsecond || avg > 10100*time.Microsecond {
+		t.Errorf("average interval %v, want about 10ms", avg)
+	}
+	p.Flood = true
+	if d := p.nextInterval(); d != floodInterval {
+		t.Errorf("nextInterval() in Flood = %v, want %v", d, floodInterval)
+	}
+}
+
+func TestRecordRoute(t *testing.T) {
+	// a header with a NOP and a Record Route option holding two addresses
+	hdr := make([]byte, 60)
+	hdr[0] = 0x4f
+	copy(hdr[20:], recordRouteOption())
+	hdr[23] = 12
+	copy(hdr[24:], []byte{10, 0, 0, 1, 192, 168, 1, 1})
+	route := parseRoute(hdr)
+	if len(route) != 2 || !route[0].Equal(net.IPv4(10, 0, 0, 1)) || !route[1].Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("parseRoute() = %v, want [10.0.0.1 192.168.1.1]", route)
+	}
+	if route := parseRoute(hdr[:20]); route != nil {
+		t.Errorf("parseRoute() without options = %v, want none", route)
+	}
+
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.RecordRoute = true
+	packet, err := p.Ping(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Route) == 0 || !packet.Route[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Route = %v, want to start with 127.0.0.1", packet.Route)
+	}
+
+	p = NewPinger("", "::1", time.Second, 1)
+	p.RecordRoute = true
+	if _, err := p.Ping(0); !errors.Is(err, errIPOptions) {
+		t.Errorf("Ping(0) over IPv6 error = %v, want %v", err, errIPOptions)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	hdr := make([]byte, 60)
+	hdr[0] = 0x4f
+	copy(hdr[20:], timestampOption())
+	hdr[22] = 13
+	binary.BigEndian.PutUint32(hdr[24:], 3600000)
+	binary.BigEndian.PutUint32(hdr[28:], 3600001)
+	if ts := parseTimestamps(hdr); len(ts) != 2 || ts[0] != time.Hour || ts[1] != time.Hour+time.Millisecond {
+		t.Errorf("parseTimestamps() = %v, want [1h 1h0m0.001s]", ts)
+	}
+
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Timestamp = true
+	packet, err := p.Ping(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Timestamps) == 0 {
+		t.Error("no timestamps recorded")
+	}
+	p.RecordRoute = true
+	if _, err := p.Ping(0); !errors.Is(err, errIPOptionsBoth) {
+		t.Errorf("Ping(0) with both options error = %v, want %v", err, errIPOptionsBoth)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	// seq 1 comes back with half its payload, seq 2 with more than fits
+	// in the buffer
+	reply := func(req *icmpEcho) [][]byte {
+		switch req.Seq {
+		case 1:
+			req.Data = req.Data[:len(req.Data)/2]
+		case 2:
+			req.Data = append(req.Data, make([]byte, 2000)...)
+		}
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", 50*time.Millisecond, 3)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	var truncated []bool
+	p.OnRecv = func(pkt *Packet) {
+		truncated = append(truncated, pkt.Truncated)
+		if pkt.Truncated != (pkt.Seq != 0) {
+			t.Errorf("icmp_seq=%d: Truncated = %v, Nbytes = %d", pkt.Seq, pkt.Truncated, pkt.Nbytes)
+		}
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(truncated) != 3 {
+		t.Errorf("got %d replies, want 3", len(truncated))
+	}
+	if got := p.bufferSize(); got < 1500 {
+		t.Errorf("bufferSize() = %d, want room for a 1500 byte MTU", got)
+	}
+}
+
+func TestReplyType(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = false
+	exceeded, err := (&icmpMessage{Type: icmpv4TimeExceeded, Body: &icmpError{Data: quote(t, 0)}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte {
+			if req.Seq == 1 {
+				return [][]byte{exceeded}
+			}
+			return [][]byte{echoReply(req)}
+		}), nil
+	}
+	if packet, err := p.Ping(0); err != nil || packet.Type != EchoReply {
+		t.Errorf("Ping(0) = %v, %v, want an echo reply", packet.Type, err)
+	}
+	if packet, _ := p.Ping(1); packet.Type != TimeExceeded {
+		t.Errorf("Ping(1) = %v, want time exceeded", packet.Type)
+	}
+	if got := replyType(false, icmpv6PacketTooBig); got != Other {
+		t.Errorf("replyType(Packet Too Big) = %v, want other", got)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	for _, tt := range []struct {
+		target               string
+		privileged, withOpts bool
+	}{
+		{"127.0.0.1", true, false},
+		{"127.0.0.1", true, true},
+		{"::1", true, false},
+		{"127.0.0.1", false, false},
+		{"::1", false, false},
+	} {
+		p := NewPinger("", tt.target, time.Second, 1)
+		p.Privileged = tt.privileged
+		// options lengthen the IP header, the TTL stays where it is
+		p.RecordRoute = tt.withOpts
+		packet, err := p.Ping(0)
+		if err != nil && !tt.privileged {
+			// ICMP datagram sockets are off by default on Linux
+			t.Logf("unprivileged ping to %s: %v", tt.target, err)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.TTL == 0 {
+			t.Errorf("%+v: TTL not reported", tt)
+		}
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	at := time.Date(2022, 4, 15, 5, 20, 0, 0, time.UTC)
+	var b strings.Builder
+	w := NewCSVWriter(&b)
+	for _, pkt := range []*Packet{
+		{Seq: 0, Rtt: 1500 * time.Microsecond, TTL: 64, Nbytes: 64, SentAt: at, RecvAt: at.Add(1500 * time.Microsecond)},
+		{Seq: 0, Rtt: 2 * time.Millisecond, TTL: 64, Nbytes: 64, Duplicate: true, RecvAt: at.Add(2 * time.Millisecond)},
+		{Seq: 1, Lost: true, SentAt: at.Add(time.Second)},
+		{Seq: 2, Lost: true, Err: errors.New("time to live exceeded"), SentAt: at.Add(2 * time.Second), RecvAt: at.Add(2 * time.Second)},
+	} {
+		if err := w.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `seq,timestamp,rtt_ms,ttl,bytes,result
+0,2022-04-15T05:20:00.0015Z,1.500,64,64,reply
+0,2022-04-15T05:20:00.002Z,2.000,64,64,duplicate
+1,2022-04-15T05:20:01Z,,,,timeout
+2,2022-04-15T05:20:02Z,,,,time to live exceeded
+`
+	if got := b.String(); got != want {
+		t.Errorf("CSV:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCheckAll(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	hosts := []string{"127.0.0.1", "::1", "no such host.invalid"}
+	got := CheckAll(context.Background(), hosts, 100*time.Millisecond)
+	want := map[string]bool{"127.0.0.1": true, "::1": true, "no such host.invalid": false}
+	if len(got) != len(want) {
+		t.Errorf("CheckAll() = %v, want %v", got, want)
+	}
+	for host, up := range want {
+		if got[host] != up {
+			t.Errorf("CheckAll()[%q] = %v, want %v", host, got[host], up)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := CheckAll(ctx, hosts[:1], time.Second); got["127.0.0.1"] {
+		t.Errorf("CheckAll() with a done context = %v, want everything down", got)
+	}
+}
+
+func TestCIDRHosts(t *testing.T) {
+	for _, tt := range []struct {
+		cidr string
+		want string
+	}{
+		{"192.168.1.0/30", "[192.168.1.1 192.168.1.2]"},
+		{"192.168.1.77/31", "[192.168.1.76 192.168.1.77]"},
+		{"10.0.0.1/32", "[10.0.0.1]"},
+		{"2001:db8::/126", "[2001:db8::1 2001:db8::2 2001:db8::3]"},
+	} {
+		hosts, err := cidrHosts(tt.cidr)
+		if err != nil || fmt.Sprint(hosts) != tt.want {
+			t.Errorf("cidrHosts(%s) = %v, %v, want %s", tt.cidr, hosts, err, tt.want)
+		}
+	}
+	if hosts, _ := cidrHosts("10.0.0.0/16"); len(hosts) != 65534 || hosts[255] != "10.0.1.0" {
+		t.Errorf("cidrHosts(10.0.0.0/16) = %d hosts, want 65534", len(hosts))
+	}
+	for _, cidr := range []string{"10.0.0.0/15", "10.0.0.1"} {
+		if _, err := cidrHosts(cidr); err == nil {
+			t.Errorf("cidrHosts(%s) succeeded", cidr)
+		}
+	}
+}
+
+func TestPingCIDR(t *testing.T) {
+	if _, err := PingCIDR("127.0.0.0/30", 0); err == nil {
+		t.Error("PingCIDR accepted a timeout of 0")
+	}
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	stats, err := PingCIDR("127.0.0.0/30", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all of 127.0.0.0/8 is loopback on Linux
+	if len(stats) != 2 || stats["127.0.0.1"] == nil || stats["127.0.0.1"].PacketsRecv != 1 {
+		t.Errorf("PingCIDR(127.0.0.0/30) = %v, want two hosts with 127.0.0.1 alive", stats)
+	}
+}
+
+func TestSizeSweep(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", 50*time.Millisecond, -1)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.MinSize, p.MaxSize, p.SizeStep = 16, 70, 16
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	var sizes []int
+	p.OnRecv = func(pkt *Packet) {
+		if pkt.Nbytes != 8+pkt.Size || pkt.Truncated {
+			t.Errorf("icmp_seq=%d: Nbytes = %d for a %d byte payload", pkt.Seq, pkt.Nbytes, pkt.Size)
+		}
+		sizes = append(sizes, pkt.Size)
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{16, 32, 48, 64}; fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("swept sizes %v, want %v", sizes, want)
+	}
+	if s := p.Statistics(); s.BytesSent != 4*8+16+32+48+64 {
+		t.Errorf("BytesSent = %d, want %d", s.BytesSent, 4*8+16+32+48+64)
+	}
+}
+
+// flakyConn is a fakeConn whose first writes fail with ENOBUFS.
+type flakyConn struct {
+	*fakeConn
+	failures *int
+}
+
+func (c flakyConn) Write(b []byte) (int, error) {
+	if *c.failures > 0 {
+		*c.failures--
+		return 0, os.NewSyscallError("sendto", syscall.ENOBUFS)
+	}
+	return c.fakeConn.Write(b)
+}
+
+func TestSendRetries(t *testing.T) {
+	for _, tt := range []struct {
+		retries, failures int
+		wantErr           bool
+	}{
+		{0, 1, true},
+		{3, 2, false},
+		{1, 2, true},
+	} {
+		failures := tt.failures
+		p := NewPinger("0.0.0.0", "127.0.0.1", 50*time.Millisecond, 1)
+		p.Privileged = false
+		p.SendRetries = tt.retries
+		p.dialer = func() (icmpConn, error) {
+			return flakyConn{newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), &failures}, nil
+		}
+		var gotErr bool
+		p.OnError = func(seq int, err error) { gotErr = true }
+		if err := p.RunContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// a request that couldn't be sent gets no reply
+		if recv := p.Statistics().PacketsRecv; gotErr != tt.wantErr || (recv == 1) == tt.wantErr {
+			t.Errorf("%d retries of %d failures: OnError called %v, %d received", tt.retries, tt.failures, gotErr, recv)
+		}
+	}
+}
+
+func TestMaxConsecutiveLoss(t *testing.T) {
+	// seq 1 is lost alone, from seq 3 on everything is
+	reply := func(req *icmpEcho) [][]byte {
+		if req.Seq == 1 || req.Seq >= 3 {
+			return nil
+		}
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", 5*time.Millisecond, -1)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.MaxConsecutiveLoss = 3
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	done := make(chan error)
+	go func() { done <- p.RunContext(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		p.Stop()
+		t.Fatal("Run did not stop after 3 packets in a row were lost")
+	}
+	if s := p.Statistics(); !s.LossLimitReached || s.PacketsRecv != 2 {
+		t.Errorf("LossLimitReached = %v with %d received, want true with 2", s.LossLimitReached, s.PacketsRecv)
+	}
+}
+
+func TestMaxLossStreak(t *testing.T) {
+	// the replies come in long before the losses time out, the streak
+	// still follows the order of the requests
+	lose := map[int]bool{1: true, 3: true, 4: true, 5: true, 7: true}
+	reply := func(req *icmpEcho) [][]byte {
+		if lose[req.Seq] {
+			return nil
+		}
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", 20*time.Millisecond, 8)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Statistics(); s.MaxLossStreak != 3 {
+		t.Errorf("MaxLossStreak = %d, want 3", s.MaxLossStreak)
+	}
+}
+
+func TestRecentLoss(t *testing.T) {
+	lose := map[int]bool{1: true, 3: true, 4: true, 5: true, 7: true}
+	reply := func(req *icmpEcho) [][]byte {
+		if lose[req.Seq] {
+			return nil
+		}
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", 20*time.Millisecond, 8)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.LossWindow = 4
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// three of seq 4 to 7 were lost
+	if s := p.Statistics(); s.RecentLoss != 75 || s.PacketLoss != 62.5 {
+		t.Errorf("RecentLoss, PacketLoss = %v, %v, want 75, 62.5", s.RecentLoss, s.PacketLoss)
+	}
+}
+
+func TestResolveNames(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	var lookups int
+	looked := make(chan struct{})
+	p.lookupAddr = func(addr string) ([]string, error) {
+		lookups++
+		defer close(looked)
+		return []string{"router1.isp.net."}, nil
+	}
+	ip := net.IPv4(203, 0, 113, 1)
+	if name := p.name(ip); name != "" {
+		t.Errorf("name() = %q before the lookup is done, want none", name)
+	}
+	<-looked
+	// the name is cached right after the lookup returns
+	for i := 0; i < 100 && p.name(ip) == ""; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if name := p.name(ip); name != "router1.isp.net" || lookups != 1 {
+		t.Errorf("name() = %q after %d lookups, want router1.isp.net after 1", name, lookups)
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	p.Privileged = false
+	p.Identifier = 0x1234
+	var ids []int
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte {
+			ids = append(ids, req.ID)
+			return [][]byte{echoReply(req)}
+		}), nil
+	}
+	if _, err := p.Ping(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 0x1234 {
+		t.Errorf("sent identifiers %x, want 1234", ids)
+	}
+
+	if _, err := New("127.0.0.1", WithIdentifier(0x10000)); !errors.Is(err, errIdentifier) {
+		t.Errorf("WithIdentifier(0x10000) error = %v, want %v", err, errIdentifier)
+	}
+
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	for _, privileged := range []bool{true, false} {
+		p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+		p.Privileged = privileged
+		p.Identifier = 0x4321
+		if _, err := p.Ping(0); err != nil && privileged {
+			t.Errorf("Ping(0) with Identifier: %v", err)
+		}
+	}
+}
+
+func TestOnTick(t *testing.T) {
+	// seq 1 is lost, seq 2 answered before it times out
+	reply := func(req *icmpEcho) [][]byte {
+		if req.Seq == 1 {
+			return nil
+		}
+		return [][]byte{echoReply(req)}
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", 20*time.Millisecond, 3)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) { return newFakeConn(reply), nil }
+	var seqs, recv []int
+	var stats []*Statistics
+	p.OnTick = func(seq int, s *Statistics) {
+		seqs = append(seqs, seq)
+		recv = append(recv, s.PacketsRecv)
+		stats = append(stats, s)
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// seq 2 is only settled once seq 1 is, by which time it was received
+	if fmt.Sprint(seqs) != "[0 1 2]" || fmt.Sprint(recv) != "[1 2 2]" {
+		t.Errorf("OnTick called for %v with %v received, want [0 1 2] with [1 2 2]", seqs, recv)
+	}
+	// settled at once, they share the statistics rather than build them
+	// for each
+	if len(stats) == 3 && stats[1] != stats[2] {
+		t.Error("OnTick built the statistics once per request settled together")
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, -1)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	setup := make(chan struct{})
+	p.OnSetup = func() { close(setup) }
+	done := make(chan error)
+	go func() { done <- p.RunContext(context.Background()) }()
+	<-setup
+	if err := p.RunContext(context.Background()); !errors.Is(err, errRunning) {
+		t.Errorf("second RunContext error = %v, want %v", err, errRunning)
+	}
+	p.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Errorf("RunContext after Finish error = %v, want none", err)
+	}
+}
+
+// raceEnabled reports whether the race detector is on, which drops items
+// from a sync.Pool at random.
+var raceEnabled bool
+
+func TestReadBuffers(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector drops pooled read buffers")
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 3)
+	p.Privileged = false
+	p.Interval = time.Millisecond
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	for seq := 0; seq < 2; seq++ {
+		if _, err := p.Ping(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the buffer of the first Ping is reused by the second and by Run,
+	// unless another test left one in the pool already
+	if p.readBufs > 1 {
+		t.Errorf("allocated %d read buffers, want at most 1", p.readBufs)
+	}
+}
+
+func TestAppendEchoRequest(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	for _, target := range []string{"127.0.0.1", "::1"} {
+		p := NewPinger("", target, time.Second, 1)
+		typ := icmpv4EchoRequest
+		if !p.ipv4 {
+			typ = icmpv6EchoRequest
+		}
+		want, err := (&icmpMessage{Type: typ, Body: &icmpEcho{ID: p.ident(), Seq: 3, Data: p.data(now, p.Size)}}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a dirty buffer too large, as left by an earlier request
+		b := bytes.Repeat([]byte{0xff}, 200)
+		if got := p.appendEchoRequest(b[:0], 3, now); !bytes.Equal(got, want) || &got[0] != &b[0] {
+			t.Errorf("appendEchoRequest(%s) = %x, want %x in the buffer given", target, got, want)
+		}
+	}
+}
+
+// benchPinger returns a Pinger answered by a fakeConn, for benchmarks.
+func benchPinger(count int) *Pinger {
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, count)
+	p.Privileged = false
+	p.Interval = 0
+	p.Logger = nil
+	p.dialer = func() (icmpConn, error) {
+		return newFakeConn(func(req *icmpEcho) [][]byte { return [][]byte{echoReply(req)} }), nil
+	}
+	return p
+}
+
+func BenchmarkPing(b *testing.B) {
+	p := benchPinger(1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Ping(i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendRecv measures the overhead of an echo request and its reply
+// on a socket that stays open, as with Run.
+func BenchmarkSendRecv(b *testing.B) {
+	p := benchPinger(-1)
+	c, _ := p.open()
+	defer c.Close()
+	rb := p.readBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.send(c, i, time.Now()); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := p.recv(c, rb.b, rb.oob[:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
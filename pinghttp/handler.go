@@ -0,0 +1,75 @@
+// Package pinghttp serves the statistics of running ping.Pingers as JSON
+// over HTTP, e.g. for a readiness probe:
+//
+//	http.Handle("/status", pinghttp.NewHandler(p1, p2))
+//
+// with round-trip times in milliseconds, like ping.Statistics.MarshalJSON.
+// It parallels pingprom for callers without a Prometheus server.
+package pinghttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"ping"
+)
+
+// status is the JSON of a target.
+type status struct {
+	Target                string  `json:"target"`
+	RemoteIP              string  `json:"remote_ip"`
+	PacketsSent           int     `json:"packets_sent"`
+	PacketsRecv           int     `json:"packets_recv"`
+	PacketsRecvDuplicates int     `json:"packets_recv_duplicates"`
+	PacketLoss            float64 `json:"packet_loss"`
+	MinRtt                float64 `json:"min_rtt_ms"`
+	MaxRtt                float64 `json:"max_rtt_ms"`
+	AvgRtt                float64 `json:"avg_rtt_ms"`
+	StdDevRtt             float64 `json:"stddev_rtt_ms"`
+	Jitter                float64 `json:"jitter_ms"`
+}
+
+type handler struct {
+	pingers []*ping.Pinger
+}
+
+// NewHandler returns a handler that answers GET requests with the
+// statistics of pingers, as a JSON array in the same order. It takes a
+// Snapshot of each on every request, so they can keep running in the
+// background while it serves.
+func NewHandler(pingers ...*ping.Pinger) http.Handler {
+	return &handler{pingers: pingers}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := make([]status, len(h.pingers))
+	for i, p := range h.pingers {
+		s := p.Snapshot()
+		statuses[i] = status{
+			Target:                p.Addr(),
+			RemoteIP:              p.IPAddr().String(),
+			PacketsSent:           s.PacketsSent,
+			PacketsRecv:           s.PacketsRecv,
+			PacketsRecvDuplicates: s.PacketsRecvDuplicates,
+			PacketLoss:            s.PacketLoss,
+			MinRtt:                ms(s.MinRtt),
+			MaxRtt:                ms(s.MaxRtt),
+			AvgRtt:                ms(s.AvgRtt),
+			StdDevRtt:             ms(s.StdDevRtt),
+			Jitter:                ms(s.Jitter),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// ms returns d in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,30 @@
+package pinghttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ping"
+)
+
+func TestHandler(t *testing.T) {
+	p := ping.NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	h := NewHandler(p)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	want := `[{"target":"127.0.0.1","remote_ip":"127.0.0.1","packets_sent":0,"packets_recv":0,` +
+		`"packets_recv_duplicates":0,"packet_loss":0,"min_rtt_ms":0,"max_rtt_ms":0,"avg_rtt_ms":0,` +
+		`"stddev_rtt_ms":0,"jitter_ms":0}]` + "\n"
+	if got := rec.Body.String(); rec.Code != http.StatusOK || got != want {
+		t.Errorf("GET /status = %d %s, want 200 %s", rec.Code, got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/status", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status = %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,85 @@
+// Package pinginflux writes the packets of a ping.Pinger as InfluxDB line
+// protocol, e.g.
+//
+//	ping,host=1.1.1.1 seq=3i,rtt=12.3,ttl=59i 1650000000000000000
+//	ping,host=1.1.1.1 seq=4i,lost=true 1650000001000000000
+//
+// with round-trip times in milliseconds and timestamps in nanoseconds. It
+// parallels pingprom for push-based time-series databases.
+package pinginflux
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ping"
+)
+
+// Writer writes packets as lines of the measurement ping.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Attach makes w write every packet p receives or loses, after calling the
+// OnRecv and OnLost handlers p already has. Write errors are ignored.
+func (w *Writer) Attach(p *ping.Pinger) {
+	onRecv, onLost := p.OnRecv, p.OnLost
+	p.OnRecv = func(pkt *ping.Packet) {
+		if onRecv != nil {
+			onRecv(pkt)
+		}
+		w.Write(pkt)
+	}
+	p.OnLost = func(pkt *ping.Packet) {
+		if onLost != nil {
+			onLost(pkt)
+		}
+		w.Write(pkt)
+	}
+}
+
+// tagEscaper and stringEscaper escape tag values and string field values.
+var (
+	tagEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// Write writes pkt as a line. Lost packets have lost=true, and error=
+// the ICMP error if one came back, instead of rtt and ttl.
+func (w *Writer) Write(pkt *ping.Packet) error {
+	host := pkt.Addr
+	if host == "" && pkt.IPAddr != nil {
+		host = pkt.IPAddr.String()
+	}
+	at := pkt.RecvAt
+	if at.IsZero() {
+		at = pkt.SentAt
+	}
+	fields := "seq=" + strconv.Itoa(pkt.Seq) + "i"
+	switch {
+	case pkt.Lost || pkt.Err != nil:
+		fields += ",lost=true"
+		if pkt.Err != nil {
+			fields += `,error="` + stringEscaper.Replace(pkt.Err.Error()) + `"`
+		}
+	default:
+		fields += ",rtt=" + strconv.FormatFloat(float64(pkt.Rtt.Nanoseconds())/1e6, 'f', -1, 64) +
+			",ttl=" + strconv.Itoa(pkt.TTL) + "i"
+		if pkt.Duplicate {
+			fields += ",duplicate=true"
+		}
+	}
+	line := "ping,host=" + tagEscaper.Replace(host) + " " + fields + " " + strconv.FormatInt(at.UnixNano(), 10) + "\n"
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := io.WriteString(w.w, line)
+	return err
+}
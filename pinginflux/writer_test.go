@@ -0,0 +1,32 @@
+package pinginflux
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"ping"
+)
+
+func TestWriter(t *testing.T) {
+	at := time.Unix(1650000000, 0)
+	var b strings.Builder
+	w := NewWriter(&b)
+	for _, pkt := range []*ping.Packet{
+		{Addr: "1.1.1.1", Seq: 3, Rtt: 12300 * time.Microsecond, TTL: 59, RecvAt: at},
+		{Addr: "1.1.1.1", Seq: 4, Lost: true, SentAt: at.Add(time.Second)},
+		{Addr: "my host", Seq: 5, Lost: true, Err: errors.New("time to live exceeded"), RecvAt: at.Add(2 * time.Second)},
+	} {
+		if err := w.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `ping,host=1.1.1.1 seq=3i,rtt=12.3,ttl=59i 1650000000000000000
+ping,host=1.1.1.1 seq=4i,lost=true 1650000001000000000
+ping,host=my\ host seq=5i,lost=true,error="time to live exceeded" 1650000002000000000
+`
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
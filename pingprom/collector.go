@@ -0,0 +1,57 @@
+// Package pingprom exports the statistics of a ping.Pinger as Prometheus
+// metrics. It lives in its own package so that the ping package itself
+// doesn't depend on the Prometheus client.
+package pingprom
+
+import (
+	"ping"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sentDesc = prometheus.NewDesc("ping_packets_sent_total",
+		"Number of echo requests sent.", []string{"target"}, nil)
+	recvDesc = prometheus.NewDesc("ping_packets_received_total",
+		"Number of echo replies received.", []string{"target"}, nil)
+	lossDesc = prometheus.NewDesc("ping_packet_loss_ratio",
+		"Ratio of echo requests left unanswered.", []string{"target"}, nil)
+	rttDesc = prometheus.NewDesc("ping_rtt_seconds",
+		"Round-trip time of echo requests.", []string{"target"}, nil)
+)
+
+type collector struct {
+	pinger *ping.Pinger
+}
+
+// NewCollector returns a collector for the statistics of p, labeled with
+// its target. It reads them anew on every scrape, so p can keep running
+// while it is registered.
+func NewCollector(p *ping.Pinger) prometheus.Collector {
+	return &collector{pinger: p}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sentDesc
+	ch <- recvDesc
+	ch <- lossDesc
+	ch <- rttDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.pinger.Statistics()
+	target := c.pinger.Addr()
+	ch <- prometheus.MustNewConstMetric(sentDesc, prometheus.CounterValue, float64(s.PacketsSent), target)
+	ch <- prometheus.MustNewConstMetric(recvDesc, prometheus.CounterValue, float64(s.PacketsRecv), target)
+	ch <- prometheus.MustNewConstMetric(lossDesc, prometheus.GaugeValue, s.PacketLoss/100, target)
+	// the summary covers the round-trip times AvgRtt is the average of,
+	// which leave out the warmup
+	ch <- prometheus.MustNewConstSummary(rttDesc, uint64(s.RttCount),
+		s.AvgRtt.Seconds()*float64(s.RttCount),
+		map[float64]float64{
+			0.5:  s.P50Rtt.Seconds(),
+			0.9:  s.P90Rtt.Seconds(),
+			0.95: s.P95Rtt.Seconds(),
+			0.99: s.P99Rtt.Seconds(),
+		}, target)
+}
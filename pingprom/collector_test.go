@@ -0,0 +1,58 @@
+package pingprom
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"ping"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCollector(t *testing.T) {
+	p := ping.NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	want := `
+# HELP ping_packets_sent_total Number of echo requests sent.
+# TYPE ping_packets_sent_total counter
+ping_packets_sent_total{target="127.0.0.1"} 0
+`
+	if err := testutil.CollectAndCompare(NewCollector(p), strings.NewReader(want), "ping_packets_sent_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorSummary(t *testing.T) {
+	if !ping.HasPrivilege() {
+		t.Skip("raw sockets not permitted:", ping.NonPrivMsg)
+	}
+	p := ping.NewPinger("0.0.0.0", "127.0.0.1", time.Second, 3)
+	p.Interval = time.Millisecond
+	p.WarmupCount = 1
+	if err := p.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := p.Statistics()
+	if s.PacketsRecv != 3 {
+		t.Skip("lost a reply on loopback")
+	}
+	ch := make(chan prometheus.Metric, 4)
+	NewCollector(p).Collect(ch)
+	close(ch)
+	m := &dto.Metric{}
+	for metric := range ch {
+		if metric.Desc() == rttDesc {
+			if err := metric.Write(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the warmup reply is left out of the average and so of the summary
+	sum := m.GetSummary()
+	if sum.GetSampleCount() != 2 || sum.GetSampleSum() != s.AvgRtt.Seconds()*2 {
+		t.Errorf("count, sum = %d, %v, want 2, %v", sum.GetSampleCount(), sum.GetSampleSum(), s.AvgRtt.Seconds()*2)
+	}
+}
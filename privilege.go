@@ -1,31 +1,159 @@
 package ping
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"sync"
 )
 
+// ErrNoPrivilege is reported, wrapped with the reason and what to do about
+// it, when a raw ICMP socket can't be opened for lack of permission.
+var ErrNoPrivilege = errors.New("raw ICMP sockets not permitted")
+
+// privilegeError is the error of a raw socket denied for lack of
+// permission. It is ErrNoPrivilege and unwraps to the error of the system.
+type privilegeError struct {
+	err error
+}
+
+func (e *privilegeError) Error() string {
+	return ErrNoPrivilege.Error() + ": " + e.err.Error() +
+		"; run as root, grant CAP_NET_RAW (e.g. setcap cap_net_raw+ep on the binary), or ping unprivileged"
+}
+
+func (e *privilegeError) Is(target error) bool {
+	return target == ErrNoPrivilege
+}
+
+func (e *privilegeError) Unwrap() error {
+	return e.err
+}
+
+// noPrivilege returns err, the error of opening a raw socket, as a
+// privilegeError if it is for lack of permission.
+func noPrivilege(err error) error {
+	if err != nil && errors.Is(err, os.ErrPermission) {
+		return &privilegeError{err: err}
+	}
+	return err
+}
+
+// Privileged and NonPrivMsg hold the result of HasPrivilege, and are only
+// meaningful once it has been called. Reading them directly races with
+// SetPrivileged and DetectPrivilege; HasPrivilege doesn't.
 var (
 	PrivOnce   sync.Once
 	NonPrivMsg string
 	Privileged bool
 )
 
+// privMu guards Privileged and NonPrivMsg, which pingers read from any
+// goroutine, and the probe addresses of SetPrivilegeProbe.
+var (
+	privMu      sync.RWMutex
+	probeLocal  *net.IPAddr
+	probeRemote *net.IPAddr
+)
+
+// HasPrivilege reports whether raw ICMP sockets can be opened, which
+// requires root or CAP_NET_RAW. The result is detected on first use rather
+// than when the package is loaded, by opening one to the loopback address,
+// 127.0.0.1 or else ::1, so that it reflects the permission rather than
+// reachability, or as set with SetPrivilegeProbe, unless it was set with
+// SetPrivileged first. NonPrivMsg then
+// holds the reason raw sockets can't be used, and what to do about it.
 func HasPrivilege() bool {
-	PrivOnce.Do(func() {
-		_, err := net.DialIP("ip4:icmp",
-			&net.IPAddr{IP: net.ParseIP("0.0.0.0")},
-			&net.IPAddr{IP: net.ParseIP("1.1.1.1")})
-		if err != nil {
-			Privileged = false
-			NonPrivMsg = err.Error()
-			return
-		}
-		Privileged = true
-	})
+	PrivOnce.Do(detectPrivilege)
+	privMu.RLock()
+	defer privMu.RUnlock()
 	return Privileged
 }
 
-func init() {
-	HasPrivilege()
+// SetPrivileged overrides the result of HasPrivilege, and so the default
+// of Pinger.Privileged, e.g. when detection gives a false negative.
+func SetPrivileged(privileged bool) {
+	PrivOnce.Do(func() {})
+	msg := ""
+	if !privileged {
+		msg = "raw sockets disabled with SetPrivileged"
+	}
+	setPrivileged(privileged, msg)
+}
+
+// DetectPrivilege detects again whether raw ICMP sockets can be opened,
+// e.g. after capabilities changed, and returns the new result of
+// HasPrivilege.
+func DetectPrivilege() bool {
+	PrivOnce.Do(func() {})
+	detectPrivilege()
+	return HasPrivilege()
+}
+
+// SetPrivilegeProbe makes privilege detection open its raw socket from the
+// IP address local, which may be empty to let the system choose, to the IP
+// address remote instead of loopback, e.g. where loopback is filtered or
+// only one address family is permitted. An empty remote goes back to
+// loopback. It takes effect on the next detection: the first call to
+// HasPrivilege, or DetectPrivilege.
+func SetPrivilegeProbe(local, remote string) error {
+	var laddr, raddr *net.IPAddr
+	if local != "" {
+		ip := net.ParseIP(local)
+		if ip == nil {
+			return fmt.Errorf("invalid local address %q", local)
+		}
+		laddr = &net.IPAddr{IP: ip}
+	}
+	if remote != "" {
+		ip := net.ParseIP(remote)
+		if ip == nil {
+			return fmt.Errorf("invalid remote address %q", remote)
+		}
+		raddr = &net.IPAddr{IP: ip}
+	} else if laddr != nil {
+		return errors.New("local address without a remote address")
+	}
+	if laddr != nil && (laddr.IP.To4() != nil) != (raddr.IP.To4() != nil) {
+		return fmt.Errorf("local address %s and remote address %s are of different families", laddr.IP, raddr.IP)
+	}
+	privMu.Lock()
+	defer privMu.Unlock()
+	probeLocal, probeRemote = laddr, raddr
+	return nil
+}
+
+// setPrivileged sets Privileged and NonPrivMsg.
+func setPrivileged(privileged bool, msg string) {
+	privMu.Lock()
+	defer privMu.Unlock()
+	Privileged, NonPrivMsg = privileged, msg
+}
+
+func detectPrivilege() {
+	privMu.RLock()
+	laddr, raddr := probeLocal, probeRemote
+	privMu.RUnlock()
+	var c net.Conn
+	var err error
+	if raddr != nil {
+		c, err = dialRaw(raddr.IP.To4() != nil, laddr, raddr)
+	} else {
+		// dialing sends nothing, loopback is there even offline, and ::1
+		// is for hosts without IPv4
+		c, err = dialRaw(true, nil, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			var err6 error
+			if c, err6 = dialRaw(false, nil, &net.IPAddr{IP: net.IPv6loopback}); err6 == nil {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		setPrivileged(false, noPrivilege(err).Error())
+		return
+	}
+	c.Close()
+	setPrivileged(true, "")
 }
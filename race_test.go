@@ -0,0 +1,7 @@
+//go:build race
+
+package ping
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package ping
+
+import "syscall"
+
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
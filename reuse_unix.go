@@ -0,0 +1,33 @@
+//go:build linux || darwin
+
+package ping
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reuseAddr sets SO_REUSEADDR and SO_REUSEPORT on the socket of c before it
+// is bound, like net.Dialer.Control, so that pingers sharing a host don't
+// fail to open their sockets because another one holds the same address or
+// echo identifier.
+//
+// It doesn't make them share replies: a raw socket receives every ICMP
+// message and keeps the replies carrying its echo identifier, while the
+// kernel delivers a reply to an ICMP datagram socket of that identifier, only
+// one of them if several were bound to it. Unprivileged pingers running at
+// once should thus leave Pinger.Identifier to the kernel.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if serr == nil {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,21 @@
+package ping
+
+import (
+	"os"
+	"syscall"
+)
+
+// setsockoptInt sets the integer socket option opt at level on c.
+func setsockoptInt(c syscall.Conn, level, opt, val int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, val)
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+
+package ping
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestControlConn(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	var got string
+	var rcvbuf int
+	p.ControlConn = func(network, address string, c syscall.RawConn) error {
+		got = network + " " + address
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 1<<16)
+			if serr == nil {
+				rcvbuf, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+	if _, err := p.Ping(0); err != nil {
+		t.Fatal(err)
+	}
+	if got != "ip4:icmp 127.0.0.1" || rcvbuf < 1<<16 {
+		t.Errorf("ControlConn called with %q, SO_RCVBUF %d, want ip4:icmp 127.0.0.1 and at least 65536", got, rcvbuf)
+	}
+
+	errControl := errors.New("no")
+	p.ControlConn = func(network, address string, c syscall.RawConn) error { return errControl }
+	if _, err := p.Ping(0); !errors.Is(err, errControl) {
+		t.Errorf("Ping(0) error = %v, want %v", err, errControl)
+	}
+}
+
+func TestReuseAddr(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("SO_REUSEADDR is not set on", runtime.GOOS)
+	}
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	var reuse int
+	p.ControlConn = func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			reuse, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+	if _, err := p.Ping(0); err != nil {
+		t.Fatal(err)
+	}
+	if reuse == 0 {
+		t.Error("SO_REUSEADDR not set on the raw socket")
+	}
+}
+
+func TestRecvBufferSize(t *testing.T) {
+	if !HasPrivilege() {
+		t.Skip("raw sockets not permitted:", NonPrivMsg)
+	}
+	p := NewPinger("0.0.0.0", "127.0.0.1", time.Second, 1)
+	// smaller than the default, so that it shows
+	p.RecvBufferSize = 4096
+	var rcvbuf int
+	p.ControlConn = func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			rcvbuf, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+	if _, err := p.Ping(0); err != nil {
+		t.Fatal(err)
+	}
+	// Linux doubles it
+	if rcvbuf < 4096 || rcvbuf > 8192 {
+		t.Errorf("SO_RCVBUF = %d, want 4096 or 8192", rcvbuf)
+	}
+}
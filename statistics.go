@@ -1,6 +1,10 @@
 package ping
 
 import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
 	"time"
 )
 
@@ -19,14 +23,29 @@ type Statistics struct {
 	// PacketsRecvDuplicates is the number of duplicate responses there were to a sent packet.
 	PacketsRecvDuplicates int
 
-	// PacketLoss is the percentage of packets lost.
+	// PacketsOutOfOrder is the number of responses received after one to
+	// a packet sent later.
+	PacketsOutOfOrder int
+
+	// PacketsCorrupted is the number of responses dropped for an invalid
+	// checksum.
+	PacketsCorrupted int
+
+	// PacketLoss is the percentage of packets sent that weren't answered,
+	// whether they were lost or couldn't be sent.
 	PacketLoss float64
 
+	// RecentLoss is the percentage of the last Pinger.LossWindow requests
+	// whose fate is known that were lost or couldn't be sent, or 0 if
+	// LossWindow isn't set.
+	RecentLoss float64
+
 	LocalIP string
 
 	RemoteIP string
 
-	// Rtts is all of the round-trip times sent via this pinger.
+	// Rtts is all of the round-trip times sent via this pinger, or the most
+	// recent Pinger.MaxStored of them.
 	Rtts []time.Duration
 
 	// MinRtt is the minimum round-trip time sent via this pinger.
@@ -38,7 +57,270 @@ type Statistics struct {
 	// AvgRtt is the average round-trip time sent via this pinger.
 	AvgRtt time.Duration
 
-	// StdDevRtt is the standard deviation of the round-trip times sent via
-	// this pinger.
+	// RttCount is the number of round-trip times MinRtt, MaxRtt, AvgRtt,
+	// the standard deviations and Jitter are computed over: PacketsRecv
+	// less the Pinger.WarmupCount first replies and those the clock stepped
+	// back for. Unlike Rtts it isn't limited by Pinger.MaxStored.
+	RttCount int
+
+	// StdDevRtt is the sample standard deviation of the round-trip times
+	// sent via this pinger, or 0 for less than two packets.
 	StdDevRtt time.Duration
+
+	// PopStdDevRtt is the population standard deviation of the round-trip
+	// times sent via this pinger.
+	PopStdDevRtt time.Duration
+
+	// Jitter is the mean absolute difference between the round-trip times
+	// of successive packets.
+	Jitter time.Duration
+
+	// Duration is the time from the first echo request sent to the last
+	// one, or to the last reply if that came later.
+	Duration time.Duration
+
+	// BytesSent and BytesRecv are the total size of the ICMP messages
+	// sent and of the replies received.
+	BytesSent int
+	BytesRecv int
+
+	// MinTTL, MaxTTL and LastTTL are the lowest, highest and latest TTL
+	// of the replies, or 0 if none reported one. MinTTL != MaxTTL hints at
+	// the route changing during the session, or at ECMP.
+	MinTTL  int
+	MaxTTL  int
+	LastTTL int
+
+	// LossLimitReached reports whether Run stopped because
+	// Pinger.MaxConsecutiveLoss packets in a row were lost.
+	LossLimitReached bool
+
+	// MaxLossStreak is the longest run of requests lost in a row, in the
+	// order they were sent, which tells bursts of loss from scattered
+	// loss.
+	MaxLossStreak int
+
+	// P50Rtt, P90Rtt, P95Rtt and P99Rtt are the nearest-rank percentiles of
+	// the round-trip times. Over only a handful of packets they are noisy,
+	// e.g. P99Rtt equals MaxRtt for anything less than 100 packets. Like
+	// Rtts they only cover the most recent Pinger.MaxStored packets.
+	P50Rtt time.Duration
+	P90Rtt time.Duration
+	P95Rtt time.Duration
+	P99Rtt time.Duration
+}
+
+// StatSnapshot is the part of Statistics that is cheap to take, as returned
+// by Pinger.Snapshot. See Statistics for the meaning of the fields.
+type StatSnapshot struct {
+	PacketsSent           int
+	PacketsRecv           int
+	PacketsRecvDuplicates int
+	PacketLoss            float64
+	MinRtt                time.Duration
+	MaxRtt                time.Duration
+	AvgRtt                time.Duration
+	RttCount              int
+	StdDevRtt             time.Duration
+	PopStdDevRtt          time.Duration
+	Jitter                time.Duration
+}
+
+// ComputeStats returns the statistics of rtts, as if they were the
+// round-trip times of as many replies to as many requests: the counters,
+// min, max, average, standard deviations, jitter and percentiles, computed
+// the same way a Pinger does. Rtts is a copy of rtts; the fields that only
+// a live Pinger knows, like the addresses or TTLs, are left zero.
+func ComputeStats(rtts []time.Duration) Statistics {
+	var rs rttStats
+	for _, rtt := range rtts {
+		rs.add(rtt)
+	}
+	snap := StatSnapshot{PacketsSent: len(rtts), PacketsRecv: len(rtts)}
+	rs.fill(&snap)
+	s := Statistics{
+		PacketsSent:  snap.PacketsSent,
+		PacketsRecv:  snap.PacketsRecv,
+		Rtts:         append([]time.Duration(nil), rtts...),
+		MinRtt:       snap.MinRtt,
+		MaxRtt:       snap.MaxRtt,
+		AvgRtt:       snap.AvgRtt,
+		RttCount:     snap.RttCount,
+		StdDevRtt:    snap.StdDevRtt,
+		PopStdDevRtt: snap.PopStdDevRtt,
+		Jitter:       snap.Jitter,
+	}
+	s.setPercentiles(rtts)
+	return s
+}
+
+// rttStats accumulates round-trip times one at a time, without keeping
+// them.
+type rttStats struct {
+	count  int
+	min    time.Duration
+	max    time.Duration
+	mean   float64 // in nanoseconds
+	m2     float64 // sum of squared differences from mean
+	jitter time.Duration
+	last   time.Duration
+}
+
+// add adds rtt to the statistics.
+func (rs *rttStats) add(rtt time.Duration) {
+	rs.count++
+	if rs.count == 1 || rtt < rs.min {
+		rs.min = rtt
+	}
+	if rtt > rs.max {
+		rs.max = rtt
+	}
+
+	// welford's online method for stddev, in float64 so that neither the
+	// divisions truncate nor the squares overflow
+	// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
+	x := float64(rtt)
+	delta := x - rs.mean
+	rs.mean += delta / float64(rs.count)
+	rs.m2 += delta * (x - rs.mean)
+
+	// jitter is the running mean of the difference between successive
+	// rtts, the first one has nothing to compare to
+	if rs.count > 1 {
+		diff := rtt - rs.last
+		if diff < 0 {
+			diff = -diff
+		}
+		rs.jitter += (diff - rs.jitter) / time.Duration(rs.count-1)
+	}
+	rs.last = rtt
+}
+
+// fill sets the round-trip time fields of s.
+func (rs *rttStats) fill(s *StatSnapshot) {
+	s.MinRtt, s.MaxRtt, s.Jitter = rs.min, rs.max, rs.jitter
+	s.AvgRtt = time.Duration(math.Round(rs.mean))
+	s.RttCount = rs.count
+	if n := float64(rs.count); n > 0 {
+		s.PopStdDevRtt = time.Duration(math.Round(math.Sqrt(rs.m2 / n)))
+		if n > 1 {
+			s.StdDevRtt = time.Duration(math.Round(math.Sqrt(rs.m2 / (n - 1))))
+		}
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile of the ascending
+// durations sorted, or 0 if there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// setPercentiles fills in the percentiles of s from the unsorted rtts.
+func (s *Statistics) setPercentiles(rtts []time.Duration) {
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s.P50Rtt = percentile(sorted, 50)
+	s.P90Rtt = percentile(sorted, 90)
+	s.P95Rtt = percentile(sorted, 95)
+	s.P99Rtt = percentile(sorted, 99)
+}
+
+// MarshalJSON encodes s with snake_case keys and round-trip times in
+// milliseconds.
+func (s Statistics) MarshalJSON() ([]byte, error) {
+	rtts := make([]float64, len(s.Rtts))
+	for i, rtt := range s.Rtts {
+		rtts[i] = ms(rtt)
+	}
+	return json.Marshal(struct {
+		PacketsSent           int       `json:"packets_sent"`
+		PacketsRecv           int       `json:"packets_recv"`
+		PacketsRecvDuplicates int       `json:"packets_recv_duplicates"`
+		PacketsOutOfOrder     int       `json:"packets_out_of_order"`
+		PacketsCorrupted      int       `json:"packets_corrupted"`
+		PacketLoss            float64   `json:"packet_loss"`
+		RecentLoss            float64   `json:"recent_loss"`
+		LocalIP               string    `json:"local_ip"`
+		RemoteIP              string    `json:"remote_ip"`
+		Rtts                  []float64 `json:"rtts_ms"`
+		MinRtt                float64   `json:"min_rtt_ms"`
+		MaxRtt                float64   `json:"max_rtt_ms"`
+		AvgRtt                float64   `json:"avg_rtt_ms"`
+		StdDevRtt             float64   `json:"stddev_rtt_ms"`
+		PopStdDevRtt          float64   `json:"pop_stddev_rtt_ms"`
+		Jitter                float64   `json:"jitter_ms"`
+		Duration              float64   `json:"duration_ms"`
+		BytesSent             int       `json:"bytes_sent"`
+		BytesRecv             int       `json:"bytes_recv"`
+		MinTTL                int       `json:"min_ttl"`
+		MaxTTL                int       `json:"max_ttl"`
+		LastTTL               int       `json:"last_ttl"`
+		LossLimitReached      bool      `json:"loss_limit_reached"`
+		MaxLossStreak         int       `json:"max_loss_streak"`
+		P50Rtt                float64   `json:"p50_rtt_ms"`
+		P90Rtt                float64   `json:"p90_rtt_ms"`
+		P95Rtt                float64   `json:"p95_rtt_ms"`
+		P99Rtt                float64   `json:"p99_rtt_ms"`
+	}{
+		PacketsSent:           s.PacketsSent,
+		PacketsRecv:           s.PacketsRecv,
+		PacketsRecvDuplicates: s.PacketsRecvDuplicates,
+		PacketsOutOfOrder:     s.PacketsOutOfOrder,
+		PacketsCorrupted:      s.PacketsCorrupted,
+		PacketLoss:            s.PacketLoss,
+		RecentLoss:            s.RecentLoss,
+		LocalIP:               s.LocalIP,
+		RemoteIP:              s.RemoteIP,
+		Rtts:                  rtts,
+		MinRtt:                ms(s.MinRtt),
+		MaxRtt:                ms(s.MaxRtt),
+		AvgRtt:                ms(s.AvgRtt),
+		StdDevRtt:             ms(s.StdDevRtt),
+		PopStdDevRtt:          ms(s.PopStdDevRtt),
+		Jitter:                ms(s.Jitter),
+		Duration:              ms(s.Duration),
+		BytesSent:             s.BytesSent,
+		BytesRecv:             s.BytesRecv,
+		MinTTL:                s.MinTTL,
+		MaxTTL:                s.MaxTTL,
+		LastTTL:               s.LastTTL,
+		LossLimitReached:      s.LossLimitReached,
+		MaxLossStreak:         s.MaxLossStreak,
+		P50Rtt:                ms(s.P50Rtt),
+		P90Rtt:                ms(s.P90Rtt),
+		P95Rtt:                ms(s.P95Rtt),
+		P99Rtt:                ms(s.P99Rtt),
+	})
+}
+
+// ms returns d in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// String returns s in the format of ping(8)'s summary, e.g.
+//
+//	4 packets transmitted, 4 received, 0% packet loss, time 3004ms
+//	rtt min/avg/max/mdev = 0.102/0.215/0.301/0.050 ms
+//
+// The rtt line is left out if nothing was received.
+func (s Statistics) String() string {
+	str := fmt.Sprintf("%d packets transmitted, %d received, ", s.PacketsSent, s.PacketsRecv)
+	if s.PacketsRecvDuplicates > 0 {
+		str += fmt.Sprintf("+%d duplicates, ", s.PacketsRecvDuplicates)
+	}
+	str += fmt.Sprintf("%g%% packet loss, time %dms", s.PacketLoss, s.Duration.Milliseconds())
+	if s.PacketsRecv > 0 {
+		str += fmt.Sprintf("\nrtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms",
+			ms(s.MinRtt), ms(s.AvgRtt), ms(s.MaxRtt), ms(s.StdDevRtt))
+	}
+	return str
 }
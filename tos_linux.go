@@ -0,0 +1,35 @@
+package ping
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// enableTOS asks the kernel to deliver the type of service (IPv4) or
+// traffic class (IPv6) of received packets as a control message.
+func enableTOS(c syscall.Conn, ipv4 bool) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVTOS
+	if !ipv4 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS
+	}
+	return setsockoptInt(c, level, opt, 1)
+}
+
+// parseTOS returns the type of service or traffic class carried in the
+// control message oob, or 0 if there is none.
+func parseTOS(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) >= 1:
+			// a single byte, unlike the TTL
+			return int(m.Data[0])
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4:
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package ping
+
+import "syscall"
+
+// enableTOS is a no-op on platforms without IP_RECVTOS/IPV6_RECVTCLASS,
+// where the TOS is reported as 0 unless the IP header is delivered with the
+// packet.
+func enableTOS(c syscall.Conn, ipv4 bool) error {
+	return nil
+}
+
+func parseTOS(oob []byte) int {
+	return 0
+}
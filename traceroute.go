@@ -0,0 +1,117 @@
+package ping
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Hop is a router on the path to the target, as found by Traceroute.
+type Hop struct {
+	// Number is the TTL of the probe that expired at this hop, starting
+	// at 1.
+	Number int
+
+	// Addr is the address of the router that answered, or of the target
+	// for the last hop. It is nil if the probe timed out.
+	Addr *net.IPAddr
+
+	// Rtt is the round-trip time of the probe.
+	Rtt time.Duration
+
+	// Timeout reports whether no answer arrived within Timeout.
+	Timeout bool
+
+	// Err is the Destination Unreachable error reported instead of a Time
+	// Exceeded message, if any. It ends the trace.
+	Err error
+}
+
+// Traceroute sends one echo request per TTL from 1 to maxHops, waiting up
+// to Timeout for each, and returns the routers whose Time Exceeded messages
+// came back. It stops once the target itself replies, or a router reports it
+// unreachable.
+//
+// Traceroute needs a privileged Pinger, as unprivileged sockets don't
+// deliver ICMP errors from routers along the way.
+func (p *Pinger) Traceroute(maxHops int) ([]Hop, error) {
+	if !p.Privileged {
+		return nil, errors.New("traceroute requires a privileged pinger")
+	}
+	network := "ip4:icmp"
+	if !p.ipv4 {
+		network = "ip6:ipv6-icmp"
+	}
+	// routers answer from their own addresses, which a socket connected
+	// to the target would filter out
+	c, err := net.ListenIP(network, p.laddr)
+	if err != nil {
+		return nil, noPrivilege(err)
+	}
+	defer c.Close()
+	if p.Interface != "" {
+		if err = bindToDevice(c, p.Interface); err != nil {
+			return nil, err
+		}
+	}
+	if !p.ipv4 {
+		if err = enableTTL(c, false); err != nil {
+			return nil, err
+		}
+	}
+
+	timeExceeded := icmpv4TimeExceeded
+	if !p.ipv4 {
+		timeExceeded = icmpv6TimeExceeded
+	}
+	var hops []Hop
+	rb := p.readBuffer()
+	defer putReadBuffer(rb)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if p.ipv4 {
+			err = ipv4.NewPacketConn(c).SetTTL(ttl)
+		} else {
+			err = ipv6.NewPacketConn(c).SetHopLimit(ttl)
+		}
+		if err != nil {
+			return hops, err
+		}
+		start := time.Now()
+		if _, err = c.WriteTo(p.echoRequest(ttl, start), p.raddr); err != nil {
+			return hops, err
+		}
+		c.SetReadDeadline(start.Add(p.Timeout))
+
+		hop := Hop{Number: ttl}
+		for {
+			packet, src, err := p.recv(c, rb.b, rb.oob[:])
+			if err != nil {
+				var nerr net.Error
+				if errors.As(err, &nerr) && nerr.Timeout() {
+					hop.Timeout = true
+					break
+				}
+				return hops, err
+			}
+			if packet.Seq != ttl {
+				continue
+			}
+			hop.Addr = src
+			hop.Rtt = time.Since(start)
+			if packet.Err == nil {
+				// the target itself replied
+				return append(hops, hop), nil
+			}
+			if packet.ICMPType != timeExceeded {
+				hop.Err = packet.Err
+				return append(hops, hop), nil
+			}
+			break
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
@@ -0,0 +1,37 @@
+package ping
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// enableTTL asks the kernel to deliver the TTL (IPv4) or hop limit (IPv6) of
+// received packets as a control message. It is needed whenever the kernel
+// strips the IP header before handing the packet to us.
+func enableTTL(c syscall.Conn, ipv4 bool) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVTTL
+	if !ipv4 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT
+	}
+	return setsockoptInt(c, level, opt, 1)
+}
+
+// parseTTL returns the TTL or hop limit carried in the control message oob,
+// or 0 if there is none.
+func parseTTL(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if len(m.Data) < 4 {
+			continue
+		}
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TTL ||
+			m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPLIMIT {
+			// both are passed as a native-endian int
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+
+package ping
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// enableTTL asks for the TTL (IPv4) or hop limit (IPv6) of received packets
+// as a control message through golang.org/x/net, which knows the options of
+// macOS and the BSDs. Where it doesn't, e.g. on Windows, the TTL is reported
+// as 0 unless the IP header is delivered with the packet.
+func enableTTL(c syscall.Conn, v4 bool) error {
+	pc, ok := c.(net.PacketConn)
+	if !ok {
+		return nil
+	}
+	if v4 {
+		ipv4.NewPacketConn(pc).SetControlMessage(ipv4.FlagTTL, true)
+	} else {
+		ipv6.NewPacketConn(pc).SetControlMessage(ipv6.FlagHopLimit, true)
+	}
+	return nil
+}
+
+// parseTTL returns the TTL or hop limit carried in the control message oob,
+// or 0 if there is none.
+func parseTTL(oob []byte) int {
+	var cm4 ipv4.ControlMessage
+	if cm4.Parse(oob) == nil && cm4.TTL > 0 {
+		return cm4.TTL
+	}
+	var cm6 ipv6.ControlMessage
+	if cm6.Parse(oob) == nil && cm6.HopLimit > 0 {
+		return cm6.HopLimit
+	}
+	return 0
+}